@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/agessh"
+	"filippo.io/age/armor"
+	"github.com/bitrise-io/go-utils/command"
+	"github.com/bitrise-io/go-utils/fileutil"
+	"github.com/pkg/errors"
+)
+
+// parseArtifactRecipient parses the recipient the sensitive artifacts are encrypted to:
+// either an age X25519 recipient (age1...) or an SSH public key (ssh-ed25519 / ssh-rsa).
+func parseArtifactRecipient(recipient string) (age.Recipient, error) {
+	recipient = strings.TrimSpace(recipient)
+	if strings.HasPrefix(recipient, "age1") {
+		return age.ParseX25519Recipient(recipient)
+	}
+	return agessh.ParseRecipient(recipient)
+}
+
+// writeEncryptedArtifact encrypts the content to the recipient and writes it, ASCII armored,
+// into the deploy dir. It returns the path of the artifact.
+func writeEncryptedArtifact(recipient, name string, content []byte) (string, error) {
+	deployDir := os.Getenv("BITRISE_DEPLOY_DIR")
+	if deployDir == "" {
+		return "", errors.New("BITRISE_DEPLOY_DIR is not set")
+	}
+
+	r, err := parseArtifactRecipient(recipient)
+	if err != nil {
+		return "", errors.Wrap(err, "Invalid recipient")
+	}
+
+	var buf bytes.Buffer
+	armorWriter := armor.NewWriter(&buf)
+	encryptWriter, err := age.Encrypt(armorWriter, r)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	if _, err := encryptWriter.Write(content); err != nil {
+		return "", errors.WithStack(err)
+	}
+	if err := encryptWriter.Close(); err != nil {
+		return "", errors.WithStack(err)
+	}
+	if err := armorWriter.Close(); err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	pth := filepath.Join(deployDir, name+".age")
+	if err := fileutil.WriteBytesToFileWithPermission(pth, buf.Bytes(), 0600); err != nil {
+		return "", errors.WithStack(err)
+	}
+	return pth, nil
+}
+
+// exportSensitiveOutput exports the value as a sensitive step output.
+// The value is passed on the standard input, so it does not show up in the process list.
+func exportSensitiveOutput(key, value string) error {
+	cmd := command.New("envman", "add", "--key", key, "--sensitive")
+	cmd.SetStdin(strings.NewReader(value))
+	return cmd.Run()
+}
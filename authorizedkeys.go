@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// AuthorizedKey is a single authorized_keys entry.
+type AuthorizedKey struct {
+	Key     ssh.PublicKey
+	Comment string
+	Options []string
+}
+
+// Line returns the authorized_keys line of the key.
+func (key AuthorizedKey) Line() string {
+	line := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key.Key)))
+	if len(key.Options) > 0 {
+		line = strings.Join(key.Options, ",") + " " + line
+	}
+	if key.Comment != "" {
+		line += " " + key.Comment
+	}
+	return line
+}
+
+// Fingerprint returns the SHA256 fingerprint of the key, as printed by ssh-keygen -l.
+func (key AuthorizedKey) Fingerprint() string {
+	return ssh.FingerprintSHA256(key.Key)
+}
+
+func (key AuthorizedKey) String() string {
+	if key.Comment == "" {
+		return fmt.Sprintf("%s %s", key.Key.Type(), key.Fingerprint())
+	}
+	return fmt.Sprintf("%s %s (%s)", key.Key.Type(), key.Fingerprint(), key.Comment)
+}
+
+// parseAuthorizedKeys parses newline separated authorized_keys lines.
+// Empty lines and comments are skipped.
+func parseAuthorizedKeys(content string) ([]AuthorizedKey, error) {
+	var keys []AuthorizedKey
+
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, err := parseAuthorizedKey(line)
+		if err != nil {
+			return nil, errors.Wrapf(err, "line %d", lineNum)
+		}
+		keys = append(keys, key)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return keys, nil
+}
+
+func parseAuthorizedKey(line string) (AuthorizedKey, error) {
+	if strings.Contains(line, "PRIVATE KEY") {
+		return AuthorizedKey{}, errors.New("a private key was specified, only the public key (e.g. the content of the .pub file) is allowed")
+	}
+
+	pubKey, comment, options, rest, err := ssh.ParseAuthorizedKey([]byte(line))
+	if err != nil {
+		return AuthorizedKey{}, errors.Errorf("not a valid SSH public key (%s): %s", abbreviate(line, 20), err)
+	}
+	if len(bytes.TrimSpace(rest)) > 0 {
+		return AuthorizedKey{}, errors.Errorf("unexpected content after the SSH public key: %s", abbreviate(string(rest), 20))
+	}
+
+	return AuthorizedKey{Key: pubKey, Comment: comment, Options: options}, nil
+}
+
+func abbreviate(s string, maxLen int) string {
+	if len(s) <= maxLen {
+		return s
+	}
+	return s[:maxLen] + "..."
+}
+
+// installAuthorizedKeys appends the keys, which are not yet present, to the given authorized_keys file.
+// The restrictions are added to the options of every appended key.
+func installAuthorizedKeys(pth string, keys []AuthorizedKey, restrictions AuthorizedKeyRestrictions) error {
+	content, err := ioutil.ReadFile(pth)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Can't read file (%s), error: %v", pth, err)
+	}
+
+	present := map[string]bool{}
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// entries not understood by the parser are left untouched
+		if key, err := parseAuthorizedKey(line); err == nil {
+			present[string(key.Key.Marshal())] = true
+		}
+	}
+
+	var lines []string
+	for _, key := range keys {
+		id := string(key.Key.Marshal())
+		if present[id] {
+			log.Printf("Already authorized, skipping: %s", key)
+			continue
+		}
+		present[id] = true
+
+		restricted, err := restrictions.Apply(key)
+		if err != nil {
+			return errors.Wrapf(err, "Can't restrict %s", key)
+		}
+		lines = append(lines, restricted.Line())
+		log.Printf("Authorizing: %s", key)
+	}
+
+	if len(lines) == 0 {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(pth), 0700); err != nil {
+		return fmt.Errorf("Can't create directory (%s), error: %v", filepath.Dir(pth), err)
+	}
+
+	if err := stepJournal.RecordFile(pth); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(pth, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("Can't open file (%s), error: %v", pth, err)
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			panic(err)
+		}
+	}()
+
+	toWrite := strings.Join(lines, "\n") + "\n"
+	if len(content) > 0 && !bytes.HasSuffix(content, []byte("\n")) {
+		toWrite = "\n" + toWrite
+	}
+	if _, err = f.WriteString(toWrite); err != nil {
+		return fmt.Errorf("Can't write SSH Public Key, error: %v", err)
+	}
+	return nil
+}
+
+// AuthorizedKeyRestrictions are the authorized_keys options added to every key the step installs.
+type AuthorizedKeyRestrictions struct {
+	ExpiryTime        time.Time
+	NoAgentForwarding bool
+	NoPortForwarding  bool
+	Restrict          bool
+	Command           string
+}
+
+func (restrictions AuthorizedKeyRestrictions) options() []string {
+	var options []string
+	if restrictions.Restrict {
+		options = append(options, "restrict")
+	}
+	if !restrictions.ExpiryTime.IsZero() {
+		options = append(options, fmt.Sprintf(`expiry-time="%s"`, restrictions.ExpiryTime.UTC().Format("200601021504Z")))
+	}
+	if restrictions.NoAgentForwarding {
+		options = append(options, "no-agent-forwarding")
+	}
+	if restrictions.NoPortForwarding {
+		options = append(options, "no-port-forwarding")
+	}
+	if restrictions.Command != "" {
+		options = append(options, fmt.Sprintf(`command="%s"`, strings.Replace(restrictions.Command, `"`, `\"`, -1)))
+	}
+	return options
+}
+
+// Apply returns the key with the restriction options merged into its own options.
+// An option of the key with the same name is only kept if it is stricter: the earlier expiry time is kept,
+// and a forced command different from the restriction one is a conflict.
+func (restrictions AuthorizedKeyRestrictions) Apply(key AuthorizedKey) (AuthorizedKey, error) {
+	flags := map[string]bool{}
+	for _, option := range restrictions.options() {
+		if !strings.Contains(option, "=") {
+			flags[option] = true
+		}
+	}
+
+	var options []string
+	for _, option := range key.Options {
+		switch name := authorizedKeyOptionName(option); {
+		case name == "expiry-time" && !restrictions.ExpiryTime.IsZero():
+			expiryTime, err := parseAuthorizedKeyExpiryTime(authorizedKeyOptionValue(option))
+			if err != nil {
+				return AuthorizedKey{}, err
+			}
+			if !expiryTime.Before(restrictions.ExpiryTime) {
+				continue
+			}
+			// the key expires earlier than required
+			restrictions.ExpiryTime = time.Time{}
+		case name == "command" && restrictions.Command != "":
+			if authorizedKeyOptionValue(option) != restrictions.Command {
+				return AuthorizedKey{}, errors.Errorf("the key has a forced command (%s) different from the required one", option)
+			}
+			continue
+		case flags[name]:
+			continue
+		}
+		options = append(options, option)
+	}
+	key.Options = append(options, restrictions.options()...)
+	return key, nil
+}
+
+func (restrictions AuthorizedKeyRestrictions) validate() error {
+	if strings.ContainsAny(restrictions.Command, "\r\n") {
+		return errors.New("the forced command should be a single line")
+	}
+	return nil
+}
+
+func authorizedKeyOptionName(option string) string {
+	return strings.ToLower(strings.SplitN(option, "=", 2)[0])
+}
+
+// authorizedKeyOptionValue returns the unquoted value of the option.
+func authorizedKeyOptionValue(option string) string {
+	kv := strings.SplitN(option, "=", 2)
+	if len(kv) != 2 {
+		return ""
+	}
+	value := kv[1]
+	if len(value) >= 2 && strings.HasPrefix(value, `"`) && strings.HasSuffix(value, `"`) {
+		value = strings.Replace(value[1:len(value)-1], `\"`, `"`, -1)
+	}
+	return value
+}
+
+// parseAuthorizedKeyExpiryTime parses the YYYYMMDD[HHMM[SS]] value of the expiry-time option,
+// in UTC if it ends with Z, otherwise in the local time zone, as sshd does.
+func parseAuthorizedKeyExpiryTime(value string) (time.Time, error) {
+	loc := time.Local
+	if strings.HasSuffix(value, "Z") {
+		value = strings.TrimSuffix(value, "Z")
+		loc = time.UTC
+	}
+
+	for _, layout := range []string{"20060102", "200601021504", "20060102150405"} {
+		if len(value) != len(layout) {
+			continue
+		}
+		if expiryTime, err := time.ParseInLocation(layout, value, loc); err == nil {
+			return expiryTime, nil
+		}
+	}
+	return time.Time{}, errors.Errorf("invalid expiry-time option of the key: %s", value)
+}
+
+// parseCertificateAuthorityKey parses the SSH CA public key, optionally in authorized_keys format.
+func parseCertificateAuthorityKey(caKey string) (AuthorizedKey, error) {
+	keys, err := parseAuthorizedKeys(caKey)
+	if err != nil {
+		return AuthorizedKey{}, err
+	}
+	if len(keys) != 1 {
+		return AuthorizedKey{}, errors.Errorf("exactly one CA public key is expected, found: %d", len(keys))
+	}
+
+	key := keys[0]
+	if _, isCert := key.Key.(*ssh.Certificate); isCert {
+		return AuthorizedKey{}, errors.New("a certificate was specified instead of the public key of the CA")
+	}
+	return key, nil
+}
+
+func validateCertificatePrincipals(principals []string) error {
+	for _, principal := range principals {
+		if strings.ContainsAny(principal, "\",\\ \t") {
+			return errors.Errorf("invalid principal: %s", principal)
+		}
+	}
+	return nil
+}
+
+// AddCertificateAuthority trusts the user certificates issued by the given SSH CA for any of the given principals.
+// If no principal is specified, the certificates have to be issued for the name of the user.
+func AddCertificateAuthority(authorizedKeysPth, caKey string, principals []string, restrictions AuthorizedKeyRestrictions) error {
+	key, err := parseCertificateAuthorityKey(caKey)
+	if err != nil {
+		return errors.Wrap(err, "Invalid SSH CA public key")
+	}
+
+	var options []string
+	for _, option := range key.Options {
+		name := authorizedKeyOptionName(option)
+		if name != "cert-authority" && name != "principals" {
+			options = append(options, option)
+		}
+	}
+	options = append(options, "cert-authority")
+	if len(principals) > 0 {
+		options = append(options, fmt.Sprintf(`principals="%s"`, strings.Join(principals, ",")))
+	}
+	key.Options = options
+
+	return installAuthorizedKeys(authorizedKeysPth, []AuthorizedKey{key}, restrictions)
+}
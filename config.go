@@ -1,40 +1,340 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/bitrise-io/go-utils/log"
 	"github.com/pkg/errors"
 )
 
+// VNC tunnel modes
+const (
+	vncTunnelModePublic = "public"
+	vncTunnelModeSSH    = "ssh"
+)
+
+// run modes
+const (
+	runModeSession  = "session"
+	runModeRollback = "rollback"
+)
+
 // ConfigsModel ...
 type ConfigsModel struct {
-	SSHPublicKey    string
-	PasswordToSet   string
-	NgrokAuthToken  string
-	IsStepDebugMode bool
+	SSHPublicKey string
+	GitHubUsers  []string
+	GitHubURL    string
+
+	SSHCAPublicKey  string
+	SSHCAPrincipals []string
+
+	GenerateSSHKey    bool
+	ArtifactRecipient string
+
+	SSHKeyLifetime          time.Duration
+	SSHKeyFrom              []string
+	SSHKeyNoAgentForwarding bool
+	SSHKeyNoPortForwarding  bool
+	SSHKeyRestrict          bool
+	SSHKeyCommand           string
+
+	VNCPassword  string
+	UserPassword string
+
+	ScreenSharePrivileges        string
+	VNCTunnelMode                string
+	GenerateVNCPassword          bool
+	ApplyGeneratedPasswordToUser bool
+	isVNCPasswordGenerated       bool
+
+	CurrentUserPassword string
+
+	CreateSessionUser   bool
+	SessionUsername     string
+	SessionUserIsAdmin  bool
+	SessionUserIsSudoer bool
+
+	SSHPort       int
+	SSHRemoteAddr string
+	VNCPort       int
+	VNCRemoteAddr string
+	Tunnels       []TunnelDefinition
+
+	TunnelControl          bool
+	CaptureHTTPRequests    bool
+	HARRedactHeaders       []string
+	TunnelDiscoveryTimeout time.Duration
+
+	NgrokVersion         string
+	NgrokDownloadBaseURL string
+	NgrokSHA256          string
+	NgrokInstallDir      string
+
+	NgrokAuthToken   string
+	NgrokRegion      string
+	NgrokMetadata    string
+	NgrokHTTPProxy   string
+	NgrokSOCKS5Proxy string
+	NgrokWebAddr     string
+	NgrokLogLevel    string
+	NgrokLogFormat   string
+	SessionTimeout   time.Duration
+	IdleTimeout      time.Duration
+	NgrokMaxRestarts int
+	RunMode          string
+	JournalPath      string
+	IsStepDebugMode  bool
 }
 
-func createConfigsModelFromEnvs() ConfigsModel {
-	return ConfigsModel{
-		NgrokAuthToken:  os.Getenv("ngrok_auth_token"),
-		SSHPublicKey:    os.Getenv("ssh_public_key"),
-		PasswordToSet:   os.Getenv("user_and_screen_share_password"),
+func createConfigsModelFromEnvs() (ConfigsModel, error) {
+	configs := ConfigsModel{
+		NgrokVersion:         os.Getenv("ngrok_version"),
+		NgrokDownloadBaseURL: os.Getenv("ngrok_download_base_url"),
+		NgrokSHA256:          os.Getenv("ngrok_sha256"),
+		NgrokInstallDir:      os.Getenv("ngrok_install_dir"),
+
+		NgrokAuthToken:   os.Getenv("ngrok_auth_token"),
+		NgrokRegion:      os.Getenv("ngrok_region"),
+		NgrokMetadata:    os.Getenv("ngrok_metadata"),
+		NgrokHTTPProxy:   os.Getenv("ngrok_http_proxy"),
+		NgrokSOCKS5Proxy: os.Getenv("ngrok_socks5_proxy"),
+		NgrokWebAddr:     os.Getenv("ngrok_web_addr"),
+		NgrokLogLevel:    os.Getenv("ngrok_log_level"),
+		NgrokLogFormat:   os.Getenv("ngrok_log_format"),
+
+		SSHPublicKey: os.Getenv("ssh_public_key"),
+		GitHubUsers:  parseList(os.Getenv("github_users")),
+		GitHubURL:    os.Getenv("github_url"),
+
+		SSHCAPublicKey:  os.Getenv("ssh_ca_public_key"),
+		SSHCAPrincipals: parseList(os.Getenv("ssh_ca_principals")),
+
+		GenerateSSHKey:    os.Getenv("generate_ssh_key") == "true",
+		ArtifactRecipient: os.Getenv("artifact_recipient"),
+
+		SSHKeyFrom:              parseList(os.Getenv("ssh_key_from")),
+		SSHKeyNoAgentForwarding: os.Getenv("ssh_key_no_agent_forwarding") == "true",
+		SSHKeyNoPortForwarding:  os.Getenv("ssh_key_no_port_forwarding") == "true",
+		SSHKeyRestrict:          os.Getenv("ssh_key_restrict") == "true",
+		SSHKeyCommand:           os.Getenv("ssh_key_command"),
+
+		VNCPassword:  os.Getenv("screen_share_password"),
+		UserPassword: os.Getenv("user_password"),
+
+		ScreenSharePrivileges:        os.Getenv("screen_share_privileges"),
+		VNCTunnelMode:                os.Getenv("vnc_tunnel_mode"),
+		GenerateVNCPassword:          os.Getenv("generate_screen_share_password") == "true",
+		ApplyGeneratedPasswordToUser: os.Getenv("apply_generated_password_to_user") == "true",
+
+		CurrentUserPassword: os.Getenv("current_user_password"),
+
+		CreateSessionUser:   os.Getenv("create_session_user") == "true",
+		SessionUsername:     os.Getenv("session_username"),
+		SessionUserIsAdmin:  os.Getenv("session_user_is_admin") == "true",
+		SessionUserIsSudoer: os.Getenv("session_user_is_sudoer") == "true",
+
+		SSHRemoteAddr: os.Getenv("ssh_remote_addr"),
+		VNCRemoteAddr: os.Getenv("vnc_remote_addr"),
+
+		TunnelControl:       os.Getenv("tunnel_control") == "true",
+		CaptureHTTPRequests: os.Getenv("capture_http_requests") == "true",
+		HARRedactHeaders:    parseList(os.Getenv("har_redact_headers")),
+
+		RunMode:         os.Getenv("run_mode"),
+		JournalPath:     os.Getenv("journal_path"),
 		IsStepDebugMode: os.Getenv("is_step_debug_mode") == "true",
 	}
+	if configs.RunMode == "" {
+		configs.RunMode = runModeSession
+	}
+	// the legacy input sets both the VNC and the user password
+	if legacyPassword := os.Getenv("user_and_screen_share_password"); legacyPassword != "" {
+		if configs.VNCPassword == "" {
+			configs.VNCPassword = legacyPassword
+		}
+		if configs.UserPassword == "" {
+			configs.UserPassword = legacyPassword
+		}
+	}
+	if configs.ScreenSharePrivileges == "" {
+		configs.ScreenSharePrivileges = screenSharePrivilegesFull
+	}
+	if configs.VNCTunnelMode == "" {
+		configs.VNCTunnelMode = vncTunnelModePublic
+	}
+	if configs.NgrokDownloadBaseURL == "" {
+		configs.NgrokDownloadBaseURL = ngrokDefaultDownloadBaseURL
+	}
+	if configs.NgrokInstallDir == "" {
+		configs.NgrokInstallDir = dir
+	}
+	if configs.NgrokWebAddr == "" {
+		configs.NgrokWebAddr = ngrokDefaultWebAddr
+	}
+	if configs.NgrokMetadata == "" {
+		configs.NgrokMetadata = defaultNgrokMetadata()
+	}
+	if configs.GitHubURL == "" {
+		configs.GitHubURL = "https://github.com"
+	}
+
+	var err error
+	if configs.SessionTimeout, err = parseMinutes("session_timeout"); err != nil {
+		return ConfigsModel{}, err
+	}
+	if configs.IdleTimeout, err = parseMinutes("idle_timeout"); err != nil {
+		return ConfigsModel{}, err
+	}
+	if configs.SSHKeyLifetime, err = parseMinutes("ssh_key_lifetime"); err != nil {
+		return ConfigsModel{}, err
+	}
+	if configs.NgrokMaxRestarts, err = parseNonNegativeInt("ngrok_max_restarts"); err != nil {
+		return ConfigsModel{}, err
+	}
+	if configs.TunnelDiscoveryTimeout, err = parseSeconds("tunnel_discovery_timeout", defaultTunnelDiscoveryTimeout); err != nil {
+		return ConfigsModel{}, err
+	}
+	if configs.SSHPort, err = parsePort("ssh_port", 22); err != nil {
+		return ConfigsModel{}, err
+	}
+	if configs.VNCPort, err = parsePort("vnc_port", 5900); err != nil {
+		return ConfigsModel{}, err
+	}
+	if configs.Tunnels, err = parseTunnelDefinitions(os.Getenv("tunnels")); err != nil {
+		return ConfigsModel{}, errors.Wrap(err, "Invalid tunnels")
+	}
+
+	return configs, nil
+}
+
+// parseList splits the given input by newlines and commas, empty items are dropped.
+func parseList(value string) []string {
+	var items []string
+	for _, item := range strings.FieldsFunc(value, func(r rune) bool { return r == '\n' || r == ',' }) {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseNonNegativeInt parses the given input as a non-negative whole number, an empty input means 0.
+func parseNonNegativeInt(key string) (int, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return 0, nil
+	}
+
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, errors.Errorf("Invalid %s (%s): should be a whole number", key, value)
+	}
+	if i < 0 {
+		return 0, errors.Errorf("Invalid %s (%s): should not be negative", key, value)
+	}
+	return i, nil
+}
+
+// parsePort parses the given input as a TCP port, an empty input means the default port.
+func parsePort(key string, defaultPort int) (int, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultPort, nil
+	}
+
+	if err := validatePort(value); err != nil {
+		return 0, errors.Errorf("Invalid %s (%s): should be a port number between 1 and 65535", key, value)
+	}
+	port, _ := strconv.Atoi(value)
+	return port, nil
+}
+
+// parseMinutes parses the given input as a non-negative number of minutes, an empty input means 0.
+func parseMinutes(key string) (time.Duration, error) {
+	minutes, err := parseNonNegativeInt(key)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(minutes) * time.Minute, nil
+}
+
+// parseSeconds parses the given input as a positive number of seconds, an empty input means the default duration.
+func parseSeconds(key string, defaultDuration time.Duration) (time.Duration, error) {
+	if os.Getenv(key) == "" {
+		return defaultDuration, nil
+	}
+
+	seconds, err := parseNonNegativeInt(key)
+	if err != nil {
+		return 0, err
+	}
+	if seconds == 0 {
+		return 0, errors.Errorf("Invalid %s (0): should be a positive number of seconds", key)
+	}
+	return time.Duration(seconds) * time.Second, nil
 }
 
 func (configs ConfigsModel) print() {
 	fmt.Println()
 	log.Infof("Ngrok Configs:")
 	log.Printf("- IsStepDebugMode: %t", configs.IsStepDebugMode)
+	log.Printf("- RunMode: %s", configs.RunMode)
+	log.Printf("- JournalPath: %s", configs.JournalPath)
 	log.Printf("- SSHPublicKey: %s", configs.SSHPublicKey)
-	if configs.IsStepDebugMode {
-		log.Printf("- PasswordToSet: %s", configs.PasswordToSet)
-	} else {
-		log.Printf("- PasswordToSet: ***")
+	log.Printf("- GitHubUsers: %s", strings.Join(configs.GitHubUsers, ", "))
+	log.Printf("- GitHubURL: %s", configs.GitHubURL)
+	log.Printf("- SSHCAPublicKey: %s", configs.SSHCAPublicKey)
+	log.Printf("- SSHCAPrincipals: %s", strings.Join(configs.SSHCAPrincipals, ", "))
+	log.Printf("- GenerateSSHKey: %t", configs.GenerateSSHKey)
+	log.Printf("- ArtifactRecipient: %s", configs.ArtifactRecipient)
+	log.Printf("- SSHKeyLifetime: %s", durationOrDisabled(configs.SSHKeyLifetime))
+	log.Printf("- SSHKeyFrom: %s", strings.Join(configs.SSHKeyFrom, ", "))
+	log.Printf("- SSHKeyNoAgentForwarding: %t", configs.SSHKeyNoAgentForwarding)
+	log.Printf("- SSHKeyNoPortForwarding: %t", configs.SSHKeyNoPortForwarding)
+	log.Printf("- SSHKeyRestrict: %t", configs.SSHKeyRestrict)
+	log.Printf("- SSHKeyCommand: %s", configs.SSHKeyCommand)
+	log.Printf("- SSHPort: %d", configs.SSHPort)
+	log.Printf("- SSHRemoteAddr: %s", configs.SSHRemoteAddr)
+	log.Printf("- VNCPort: %d", configs.VNCPort)
+	log.Printf("- VNCRemoteAddr: %s", configs.VNCRemoteAddr)
+	for _, tunnel := range configs.Tunnels {
+		log.Printf("- Tunnel: %s", tunnel)
 	}
+	log.Printf("- TunnelControl: %t", configs.TunnelControl)
+	log.Printf("- CaptureHTTPRequests: %t", configs.CaptureHTTPRequests)
+	log.Printf("- HARRedactHeaders: %s", strings.Join(configs.HARRedactHeaders, ", "))
+	log.Printf("- SessionTimeout: %s", durationOrDisabled(configs.SessionTimeout))
+	log.Printf("- IdleTimeout: %s", durationOrDisabled(configs.IdleTimeout))
+	log.Printf("- NgrokMaxRestarts: %d", configs.NgrokMaxRestarts)
+	log.Printf("- TunnelDiscoveryTimeout: %s", configs.TunnelDiscoveryTimeout)
+	log.Printf("- VNCPassword: %s", configs.secret(configs.VNCPassword))
+	log.Printf("- ScreenSharePrivileges: %s", configs.ScreenSharePrivileges)
+	log.Printf("- VNCTunnelMode: %s", configs.VNCTunnelMode)
+	log.Printf("- GenerateVNCPassword: %t", configs.GenerateVNCPassword)
+	log.Printf("- ApplyGeneratedPasswordToUser: %t", configs.ApplyGeneratedPasswordToUser)
+	log.Printf("- UserPassword: %s", configs.secret(configs.UserPassword))
+	log.Printf("- CurrentUserPassword: %s", configs.secret(configs.CurrentUserPassword))
+	log.Printf("- CreateSessionUser: %t", configs.CreateSessionUser)
+	log.Printf("- SessionUsername: %s", configs.SessionUsername)
+	log.Printf("- SessionUserIsAdmin: %t", configs.SessionUserIsAdmin)
+	log.Printf("- SessionUserIsSudoer: %t", configs.SessionUserIsSudoer)
+	log.Printf("- NgrokVersion: %s", configs.NgrokVersion)
+	log.Printf("- NgrokDownloadBaseURL: %s", configs.NgrokDownloadBaseURL)
+	log.Printf("- NgrokSHA256: %s", configs.NgrokSHA256)
+	log.Printf("- NgrokInstallDir: %s", configs.NgrokInstallDir)
+	log.Printf("- NgrokRegion: %s", configs.NgrokRegion)
+	log.Printf("- NgrokMetadata: %s", configs.NgrokMetadata)
+	log.Printf("- NgrokHTTPProxy: %s", redactURL(configs.NgrokHTTPProxy))
+	log.Printf("- NgrokSOCKS5Proxy: %s", redactURL(configs.NgrokSOCKS5Proxy))
+	log.Printf("- NgrokWebAddr: %s", configs.NgrokWebAddr)
+	log.Printf("- NgrokLogLevel: %s", configs.NgrokLogLevel)
+	log.Printf("- NgrokLogFormat: %s", configs.NgrokLogFormat)
 	if configs.IsStepDebugMode {
 		log.Printf("- NgrokAuthToken: %s", configs.NgrokAuthToken)
 	} else {
@@ -44,12 +344,212 @@ func (configs ConfigsModel) print() {
 }
 
 func (configs ConfigsModel) validate() error {
+	if configs.JournalPath == "" {
+		return errors.New("No JournalPath parameter specified")
+	}
+	switch configs.RunMode {
+	case runModeSession:
+	case runModeRollback:
+		return nil
+	default:
+		return errors.Errorf("Invalid RunMode (%s), should be one of: %s, %s", configs.RunMode, runModeSession, runModeRollback)
+	}
+
 	if configs.NgrokAuthToken == "" {
 		return errors.New("No NgrokAuthToken parameter specified")
 	}
-	if configs.PasswordToSet == "" && configs.SSHPublicKey == "" {
-		return errors.New("Neither SSHPublicKey nor (VNC) PasswordToSet specified. At least one is required")
+	if err := configs.ngrokAgentOptions().validate(); err != nil {
+		return errors.Wrap(err, "Invalid ngrok agent options")
+	}
+	if err := configs.ngrokInstallOptions().validate(); err != nil {
+		return errors.Wrap(err, "Invalid ngrok install options")
+	}
+	if !configs.isVNCEnabled() && !configs.isSSHEnabled() && len(configs.Tunnels) == 0 {
+		return errors.New("Neither SSHPublicKey / GitHubUsers / SSHCAPublicKey / GenerateSSHKey nor VNCPassword / GenerateVNCPassword nor Tunnels specified. At least one is required")
+	}
+	for _, tunnel := range configs.Tunnels {
+		if tunnel.Name == sshTunnelName || tunnel.Name == vncTunnelName {
+			return errors.Errorf("Invalid Tunnels: the %s and %s tunnel names are reserved", sshTunnelName, vncTunnelName)
+		}
+	}
+	if err := validateTunnelDefinitions(configs.tunnelDefinitions()); err != nil {
+		return errors.Wrap(err, "Invalid Tunnels")
+	}
+	if configs.VNCRemoteAddr != "" && configs.VNCTunnelMode != vncTunnelModePublic {
+		log.Warnf("VNCRemoteAddr is ignored, as the VNC port is not exposed publicly (VNCTunnelMode: %s)", configs.VNCTunnelMode)
+	}
+	if configs.SSHPublicKey != "" {
+		keys, err := parseAuthorizedKeys(configs.SSHPublicKey)
+		if err != nil {
+			return errors.Wrap(err, "Invalid SSHPublicKey")
+		}
+		if len(keys) == 0 {
+			return errors.New("Invalid SSHPublicKey: no SSH public key found")
+		}
+	}
+	for _, username := range configs.GitHubUsers {
+		if err := validateGitHubUsername(username); err != nil {
+			return errors.Wrap(err, "Invalid GitHubUsers")
+		}
+	}
+	if configs.SSHCAPublicKey != "" {
+		if _, err := parseCertificateAuthorityKey(configs.SSHCAPublicKey); err != nil {
+			return errors.Wrap(err, "Invalid SSHCAPublicKey")
+		}
+	}
+	if err := validateCertificatePrincipals(configs.SSHCAPrincipals); err != nil {
+		return errors.Wrap(err, "Invalid SSHCAPrincipals")
+	}
+	if _, ok := screenSharePrivileges[configs.ScreenSharePrivileges]; !ok {
+		return errors.Errorf("Invalid ScreenSharePrivileges (%s), should be one of: %s, %s, %s", configs.ScreenSharePrivileges, screenSharePrivilegesObserve, screenSharePrivilegesControl, screenSharePrivilegesFull)
+	}
+	switch configs.VNCTunnelMode {
+	case vncTunnelModePublic:
+	case vncTunnelModeSSH:
+		if configs.isVNCEnabled() && !configs.isSSHEnabled() {
+			return errors.New("VNCTunnelMode is ssh, but no SSH public key (SSHPublicKey / GitHubUsers / SSHCAPublicKey / GenerateSSHKey) specified")
+		}
+		if configs.isVNCEnabled() && (configs.SSHKeyNoPortForwarding || configs.SSHKeyRestrict) {
+			return errors.New("VNCTunnelMode is ssh, which requires SSH port forwarding, but SSHKeyNoPortForwarding or SSHKeyRestrict is enabled")
+		}
+	default:
+		return errors.Errorf("Invalid VNCTunnelMode (%s), should be one of: %s, %s", configs.VNCTunnelMode, vncTunnelModePublic, vncTunnelModeSSH)
+	}
+	if configs.CaptureHTTPRequests && !configs.hasHTTPTunnel() {
+		return errors.New("CaptureHTTPRequests is enabled, but no http tunnel is specified in Tunnels")
+	}
+	if configs.CreateSessionUser {
+		if err := validateSessionUsername(configs.SessionUsername); err != nil {
+			return errors.Wrap(err, "Invalid SessionUsername")
+		}
+	}
+	if configs.ArtifactRecipient != "" {
+		if _, err := parseArtifactRecipient(configs.ArtifactRecipient); err != nil {
+			return errors.Wrap(err, "Invalid ArtifactRecipient")
+		}
+	}
+	if _, err := url.ParseRequestURI(configs.GitHubURL); err != nil {
+		return errors.Wrap(err, "Invalid GitHubURL")
+	}
+	if err := configs.authorizedKeyRestrictions().validate(); err != nil {
+		return errors.Wrap(err, "Invalid SSH key restrictions")
+	}
+	if _, _, err := parseIPRestriction(configs.SSHKeyFrom); err != nil {
+		return errors.Wrap(err, "Invalid SSHKeyFrom")
 	}
 
 	return nil
 }
+
+// isSSHEnabled returns true if any SSH access is configured.
+func (configs ConfigsModel) isSSHEnabled() bool {
+	return configs.SSHPublicKey != "" || len(configs.GitHubUsers) > 0 || configs.SSHCAPublicKey != "" || configs.GenerateSSHKey
+}
+
+// isVNCEnabled returns true if screen sharing is configured.
+func (configs ConfigsModel) isVNCEnabled() bool {
+	return configs.VNCPassword != "" || configs.GenerateVNCPassword
+}
+
+// ngrokInstallOptions returns which ngrok agent to use, and where to get it from.
+func (configs ConfigsModel) ngrokInstallOptions() NgrokInstallOptions {
+	return NgrokInstallOptions{
+		Version:         configs.NgrokVersion,
+		DownloadBaseURL: configs.NgrokDownloadBaseURL,
+		SHA256:          configs.NgrokSHA256,
+		InstallDir:      configs.NgrokInstallDir,
+	}
+}
+
+// ngrokAgentOptions returns the session level options of the ngrok agent.
+func (configs ConfigsModel) ngrokAgentOptions() NgrokAgentOptions {
+	return NgrokAgentOptions{
+		Authtoken:   configs.NgrokAuthToken,
+		Region:      configs.NgrokRegion,
+		Metadata:    configs.NgrokMetadata,
+		HTTPProxy:   configs.NgrokHTTPProxy,
+		SOCKS5Proxy: configs.NgrokSOCKS5Proxy,
+		WebAddr:     configs.NgrokWebAddr,
+		LogLevel:    configs.NgrokLogLevel,
+		LogFormat:   configs.NgrokLogFormat,
+	}
+}
+
+// defaultNgrokMetadata returns the slug and the URL of the current build, as JSON,
+// so the session can be found on the ngrok dashboard.
+func defaultNgrokMetadata() string {
+	buildSlug, buildURL := os.Getenv("BITRISE_BUILD_SLUG"), os.Getenv("BITRISE_BUILD_URL")
+	if buildSlug == "" && buildURL == "" {
+		return ""
+	}
+
+	metadata, err := json.Marshal(map[string]string{
+		"build_slug": buildSlug,
+		"build_url":  buildURL,
+	})
+	if err != nil {
+		return ""
+	}
+	return string(metadata)
+}
+
+// tunnelDefinitions returns the tunnels to open: the SSH and the public VNC tunnel, if enabled,
+// followed by the user-defined tunnels.
+func (configs ConfigsModel) tunnelDefinitions() []TunnelDefinition {
+	var definitions []TunnelDefinition
+	if configs.isSSHEnabled() {
+		// sshd sees the connections arriving through the tunnel as local ones, so the source addresses are restricted by ngrok
+		allow, deny, _ := parseIPRestriction(configs.SSHKeyFrom)
+		definitions = append(definitions, TunnelDefinition{Name: sshTunnelName, Proto: tunnelProtoTCP, Addr: strconv.Itoa(configs.SSHPort), RemoteAddr: configs.SSHRemoteAddr, AllowCIDRs: allow, DenyCIDRs: deny})
+	}
+	if configs.isVNCEnabled() && configs.VNCTunnelMode == vncTunnelModePublic {
+		definitions = append(definitions, TunnelDefinition{Name: vncTunnelName, Proto: tunnelProtoTCP, Addr: strconv.Itoa(configs.VNCPort), RemoteAddr: configs.VNCRemoteAddr})
+	}
+	return append(definitions, configs.Tunnels...)
+}
+
+// hasHTTPTunnel returns true if any of the user-defined tunnels is an http tunnel.
+func (configs ConfigsModel) hasHTTPTunnel() bool {
+	for _, tunnel := range configs.Tunnels {
+		if tunnel.Proto == tunnelProtoHTTP {
+			return true
+		}
+	}
+	return false
+}
+
+// shouldGenerateSSHKey returns true if a one-time SSH key pair has to be generated,
+// which is the case if key generation is enabled and no SSH public key is specified.
+func (configs ConfigsModel) shouldGenerateSSHKey() bool {
+	return configs.GenerateSSHKey && configs.SSHPublicKey == ""
+}
+
+// authorizedKeyRestrictions returns the options to add to every authorized key,
+// the expiry time is counted from now.
+func (configs ConfigsModel) authorizedKeyRestrictions() AuthorizedKeyRestrictions {
+	restrictions := AuthorizedKeyRestrictions{
+		NoAgentForwarding: configs.SSHKeyNoAgentForwarding,
+		NoPortForwarding:  configs.SSHKeyNoPortForwarding,
+		Restrict:          configs.SSHKeyRestrict,
+		Command:           configs.SSHKeyCommand,
+	}
+	if configs.SSHKeyLifetime > 0 {
+		restrictions.ExpiryTime = time.Now().Add(configs.SSHKeyLifetime)
+	}
+	return restrictions
+}
+
+// secret returns the value to print for a secret input, which is only revealed in debug mode.
+func (configs ConfigsModel) secret(value string) string {
+	if configs.IsStepDebugMode {
+		return value
+	}
+	return "***"
+}
+
+func durationOrDisabled(d time.Duration) string {
+	if d == 0 {
+		return "disabled"
+	}
+	return d.String()
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+const testSSHPublicKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl ca@example.com"
+
+// setEnvs sets the given step inputs for the duration of the test.
+func setEnvs(t *testing.T, envs map[string]string) {
+	for key, value := range envs {
+		t.Setenv(key, value)
+	}
+}
+
+func TestCreateConfigsModelFromEnvs(t *testing.T) {
+	tests := []struct {
+		name  string
+		envs  map[string]string
+		check func(t *testing.T, configs ConfigsModel)
+	}{
+		{
+			name: "SSH CA",
+			envs: map[string]string{
+				"ssh_ca_public_key": testSSHPublicKey,
+				"ssh_ca_principals": "alice, bob\ncarol",
+			},
+			check: func(t *testing.T, configs ConfigsModel) {
+				if configs.SSHCAPublicKey != testSSHPublicKey {
+					t.Errorf("unexpected SSHCAPublicKey: %s", configs.SSHCAPublicKey)
+				}
+				if want := []string{"alice", "bob", "carol"}; !reflect.DeepEqual(configs.SSHCAPrincipals, want) {
+					t.Errorf("unexpected SSHCAPrincipals: %v, want: %v", configs.SSHCAPrincipals, want)
+				}
+			},
+		},
+		{
+			name: "SSH source addresses",
+			envs: map[string]string{
+				"ssh_public_key": testSSHPublicKey,
+				"ssh_key_from":   "203.0.113.0/24, 198.51.100.7\n!203.0.113.1\n2001:db8::1",
+			},
+			check: func(t *testing.T, configs ConfigsModel) {
+				ssh := configs.tunnelDefinitions()[0]
+				if want := []string{"203.0.113.0/24", "198.51.100.7/32", "2001:db8::1/128"}; !reflect.DeepEqual(ssh.AllowCIDRs, want) {
+					t.Errorf("unexpected AllowCIDRs: %v, want: %v", ssh.AllowCIDRs, want)
+				}
+				if want := []string{"203.0.113.1/32"}; !reflect.DeepEqual(ssh.DenyCIDRs, want) {
+					t.Errorf("unexpected DenyCIDRs: %v, want: %v", ssh.DenyCIDRs, want)
+				}
+			},
+		},
+		{
+			name: "generated SSH key",
+			envs: map[string]string{
+				"generate_ssh_key":   "true",
+				"artifact_recipient": testSSHPublicKey,
+			},
+			check: func(t *testing.T, configs ConfigsModel) {
+				if !configs.GenerateSSHKey || !configs.shouldGenerateSSHKey() {
+					t.Errorf("expected the SSH key to be generated")
+				}
+				if configs.ArtifactRecipient != testSSHPublicKey {
+					t.Errorf("unexpected ArtifactRecipient: %s", configs.ArtifactRecipient)
+				}
+			},
+		},
+		{
+			name: "generated VNC password",
+			envs: map[string]string{
+				"generate_screen_share_password":   "true",
+				"apply_generated_password_to_user": "true",
+			},
+			check: func(t *testing.T, configs ConfigsModel) {
+				if !configs.GenerateVNCPassword || !configs.isVNCEnabled() {
+					t.Errorf("expected the VNC password to be generated")
+				}
+				if !configs.ApplyGeneratedPasswordToUser {
+					t.Errorf("expected the generated password to be applied to the user")
+				}
+			},
+		},
+		{
+			name: "default screen share privileges",
+			envs: map[string]string{
+				"screen_share_password": "password",
+			},
+			check: func(t *testing.T, configs ConfigsModel) {
+				if configs.ScreenSharePrivileges != screenSharePrivilegesFull {
+					t.Errorf("unexpected ScreenSharePrivileges: %s", configs.ScreenSharePrivileges)
+				}
+			},
+		},
+		{
+			name: "screen share privileges",
+			envs: map[string]string{
+				"screen_share_password":   "password",
+				"screen_share_privileges": screenSharePrivilegesObserve,
+			},
+			check: func(t *testing.T, configs ConfigsModel) {
+				if configs.ScreenSharePrivileges != screenSharePrivilegesObserve {
+					t.Errorf("unexpected ScreenSharePrivileges: %s", configs.ScreenSharePrivileges)
+				}
+			},
+		},
+		{
+			name: "VNC through SSH",
+			envs: map[string]string{
+				"ssh_public_key":        testSSHPublicKey,
+				"screen_share_password": "password",
+				"vnc_tunnel_mode":       vncTunnelModeSSH,
+			},
+			check: func(t *testing.T, configs ConfigsModel) {
+				if configs.VNCTunnelMode != vncTunnelModeSSH {
+					t.Errorf("unexpected VNCTunnelMode: %s", configs.VNCTunnelMode)
+				}
+				for _, definition := range configs.tunnelDefinitions() {
+					if definition.Name == vncTunnelName {
+						t.Errorf("unexpected public VNC tunnel: %s", definition)
+					}
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setEnvs(t, map[string]string{
+				"ngrok_auth_token": "token",
+				"journal_path":     "/tmp/journal.json",
+			})
+			setEnvs(t, tt.envs)
+
+			configs, err := createConfigsModelFromEnvs()
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if err := configs.validate(); err != nil {
+				t.Fatalf("unexpected validation error: %s", err)
+			}
+			tt.check(t, configs)
+		})
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bitrise-io/go-utils/fileutil"
+	"github.com/bitrise-io/go-utils/log"
+	"github.com/bitrise-steplib/steps-remote-access-macos-ngrok/internal/ngrokapi"
+	"github.com/pkg/errors"
+)
+
+const (
+	// the control socket is created in a private directory under it,
+	// so no one else can connect to it before its permissions are set
+	controlSocketParentDir = "/tmp"
+	controlSocketFileName  = "control.sock"
+	controlCommandFile     = "/tmp/remote-access-tunnel"
+)
+
+// controlCommand returns the script used from the remote session to open and close tunnels,
+// it talks to the control server of the step through the given unix socket.
+func controlCommand(socketPth string) string {
+	return `#!/bin/sh
+# Opens and closes ngrok tunnels of the running remote access session.
+
+socket="` + socketPth + `"
+
+usage() {
+  echo "Usage:" >&2
+  echo "  $0 list" >&2
+  echo "  $0 open name=NAME, addr=PORT_OR_HOST:PORT[, proto=tcp|http|tls][, ...]" >&2
+  echo "  $0 close NAME" >&2
+  exit 2
+}
+
+# the responses end with a newline, the status code is printed after them
+request() {
+  out=$(curl -sS --unix-socket "$socket" -w '%{http_code}' "$@") || exit 1
+  code=$(printf '%s\n' "$out" | tail -n 1)
+  printf '%s\n' "$out" | sed '$d'
+  [ "$code" -lt 400 ]
+}
+
+case "$1" in
+  list)
+    [ $# -eq 1 ] || usage
+    request http://localhost/tunnels
+    ;;
+  open)
+    shift
+    [ $# -gt 0 ] || usage
+    request -X POST --data-urlencode "tunnel=$*" http://localhost/tunnels
+    ;;
+  close)
+    [ $# -eq 2 ] || usage
+    request -X DELETE "http://localhost/tunnels/$2"
+    ;;
+  *)
+    usage
+    ;;
+esac
+`
+}
+
+// tunnelController opens and closes tunnels on request of the control command during the session.
+type tunnelController struct {
+	version NgrokAgentVersion
+	// names of the tunnels defined in the ngrok config
+	configured map[string]bool
+
+	mu sync.Mutex
+	// tunnels opened during the session, re-opened if the agent restarts
+	opened map[string]TunnelDefinition
+
+	socketDir string
+	server    *http.Server
+}
+
+func newTunnelController(version NgrokAgentVersion, configured []TunnelDefinition) *tunnelController {
+	controller := &tunnelController{
+		version:    version,
+		configured: map[string]bool{},
+		opened:     map[string]TunnelDefinition{},
+	}
+	for _, definition := range configured {
+		controller.configured[definition.Name] = true
+	}
+	return controller
+}
+
+// Start installs the control command and serves the control requests on the control socket.
+// The socket is handed over to the session user, if it is not the current one.
+func (controller *tunnelController) Start(sessionUser SessionUser) (err error) {
+	// the directory is created with 0700 permissions
+	socketDir, err := ioutil.TempDir(controlSocketParentDir, "remote-access-ngrok")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		if removeErr := os.RemoveAll(socketDir); removeErr != nil {
+			log.Warnf("Failed to remove the control socket directory: %s", removeErr)
+		}
+	}()
+	socketPth := filepath.Join(socketDir, controlSocketFileName)
+
+	if err := stepJournal.RecordFile(controlCommandFile); err != nil {
+		return err
+	}
+	if err := fileutil.WriteStringToFileWithPermission(controlCommandFile, controlCommand(socketPth), 0755); err != nil {
+		return errors.WithStack(err)
+	}
+
+	listener, err := net.Listen("unix", socketPth)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer func() {
+		if err != nil {
+			if closeErr := listener.Close(); closeErr != nil {
+				log.Warnf("Failed to close the control socket: %s", closeErr)
+			}
+		}
+	}()
+	if err := os.Chmod(socketPth, 0600); err != nil {
+		return errors.WithStack(err)
+	}
+	if sessionUser.IsTemporary {
+		if err := newSudoCommand("chown", sessionUser.Username, socketPth).Run(); err != nil {
+			return errors.Wrap(err, "Failed to hand over the control socket to the session user")
+		}
+		// the session user only needs to reach the socket, the directory is not listable
+		if err := os.Chmod(socketDir, 0711); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	controller.socketDir = socketDir
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/tunnels", controller.handleTunnels)
+	mux.HandleFunc("/tunnels/", controller.handleTunnel)
+	controller.server = &http.Server{Handler: mux}
+
+	go func() {
+		if err := controller.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Errorf("Tunnel control server failed: %s", err)
+		}
+	}()
+	return nil
+}
+
+// Stop stops serving the control requests, and removes the directory of the unix socket.
+func (controller *tunnelController) Stop() error {
+	if controller.socketDir != "" {
+		defer func() {
+			if err := os.RemoveAll(controller.socketDir); err != nil {
+				log.Warnf("Failed to remove the control socket directory: %s", err)
+			}
+		}()
+	}
+	if controller.server == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return errors.WithStack(controller.server.Shutdown(ctx))
+}
+
+// Reopen opens the tunnels opened during the session again, after the agent was restarted.
+func (controller *tunnelController) Reopen() {
+	controller.mu.Lock()
+	defer controller.mu.Unlock()
+
+	if len(controller.opened) == 0 {
+		return
+	}
+	fmt.Println()
+	log.Printf("Reopening the tunnels opened during the session ...")
+	for _, definition := range controller.opened {
+		tunnel, err := ngrokAPI.StartTunnel(context.Background(), definition.startTunnelRequest(controller.version))
+		if err != nil {
+			log.Errorf("Failed to reopen tunnel (%s): %s", definition.Name, err)
+			continue
+		}
+		log.Donef("Tunnel reopened: %s", definition.Name)
+		log.Printf("    %s -> %s", tunnel.PublicURL, tunnel.Config.Addr)
+	}
+}
+
+func (controller *tunnelController) handleTunnels(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		tunnels, err := ngrokAPI.ListTunnels(r.Context())
+		if err != nil {
+			controlError(w, http.StatusBadGateway, err)
+			return
+		}
+		sort.Slice(tunnels, func(i, j int) bool { return tunnels[i].Name < tunnels[j].Name })
+		for _, tunnel := range tunnels {
+			fmt.Fprintf(w, "%s: %s -> %s\n", tunnel.Name, tunnel.PublicURL, tunnel.Config.Addr)
+		}
+	case http.MethodPost:
+		controller.open(w, r)
+	default:
+		controlError(w, http.StatusMethodNotAllowed, errors.Errorf("method not allowed: %s", r.Method))
+	}
+}
+
+func (controller *tunnelController) handleTunnel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		controlError(w, http.StatusMethodNotAllowed, errors.Errorf("method not allowed: %s", r.Method))
+		return
+	}
+	controller.close(w, r, strings.TrimPrefix(r.URL.Path, "/tunnels/"))
+}
+
+func (controller *tunnelController) open(w http.ResponseWriter, r *http.Request) {
+	definition, err := parseTunnelDefinition(r.PostFormValue("tunnel"))
+	if err == nil {
+		err = definition.validate()
+	}
+	if err != nil {
+		controlError(w, http.StatusBadRequest, errors.Wrap(err, "invalid tunnel"))
+		return
+	}
+
+	controller.mu.Lock()
+	defer controller.mu.Unlock()
+
+	if controller.configured[definition.Name] {
+		controlError(w, http.StatusConflict, errors.Errorf("tunnel %s is defined in the step inputs, and is already open", definition.Name))
+		return
+	}
+	if _, ok := controller.opened[definition.Name]; ok {
+		controlError(w, http.StatusConflict, errors.Errorf("tunnel %s is already open, close it first", definition.Name))
+		return
+	}
+
+	tunnel, err := ngrokAPI.StartTunnel(r.Context(), definition.startTunnelRequest(controller.version))
+	if err != nil {
+		controlError(w, http.StatusBadGateway, errors.Wrapf(err, "failed to open tunnel %s", definition.Name))
+		return
+	}
+	controller.opened[definition.Name] = definition
+
+	fmt.Println()
+	log.Donef("Tunnel opened: %s", definition)
+	log.Printf("    %s -> %s", tunnel.PublicURL, tunnel.Config.Addr)
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, "Tunnel opened: %s -> %s\n", tunnel.PublicURL, tunnel.Config.Addr)
+}
+
+func (controller *tunnelController) close(w http.ResponseWriter, r *http.Request, name string) {
+	controller.mu.Lock()
+	defer controller.mu.Unlock()
+
+	if name == sshTunnelName {
+		controlError(w, http.StatusForbidden, errors.New("the ssh tunnel can not be closed, the session would be lost"))
+		return
+	}
+	// the agent would open the tunnels of the config again on restart
+	if controller.configured[name] {
+		controlError(w, http.StatusForbidden, errors.Errorf("tunnel %s is defined in the step inputs, and can not be closed", name))
+		return
+	}
+	if _, ok := controller.opened[name]; !ok {
+		controlError(w, http.StatusNotFound, errors.Errorf("no such tunnel: %s", name))
+		return
+	}
+
+	// the additional http tunnel of the v2 agent is closed too
+	for _, tunnelName := range []string{name, name + " (http)"} {
+		if err := ngrokAPI.StopTunnel(r.Context(), tunnelName); err != nil && !ngrokapi.IsNotFound(err) {
+			controlError(w, http.StatusBadGateway, errors.Wrapf(err, "failed to close tunnel %s", tunnelName))
+			return
+		}
+	}
+	delete(controller.opened, name)
+
+	fmt.Println()
+	log.Warnf("Tunnel closed: %s", name)
+	fmt.Fprintf(w, "Tunnel closed: %s\n", name)
+}
+
+func controlError(w http.ResponseWriter, status int, err error) {
+	fmt.Println()
+	log.Warnf("Tunnel control request failed: %s", err)
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "Error: %s\n", err)
+}
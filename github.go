@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+	"github.com/bitrise-io/go-utils/retry"
+	"github.com/pkg/errors"
+)
+
+var gitHubUsernameRegexp = regexp.MustCompile(`^[a-zA-Z0-9](?:[a-zA-Z0-9]|-[a-zA-Z0-9]){0,38}$`)
+
+func validateGitHubUsername(username string) error {
+	if !gitHubUsernameRegexp.MatchString(username) {
+		return errors.Errorf("invalid GitHub username: %s", username)
+	}
+	return nil
+}
+
+// fetchGitHubUserKeys downloads the SSH public keys published by the given user (<baseURL>/<username>.keys).
+// The keys are annotated with the username.
+func fetchGitHubUserKeys(ctx context.Context, baseURL, username string) ([]AuthorizedKey, error) {
+	keysURL := strings.TrimSuffix(baseURL, "/") + "/" + url.PathEscape(username) + ".keys"
+	client := &http.Client{Timeout: 30 * time.Second}
+
+	var body []byte
+	err := retry.Times(2).Wait(3 * time.Second).Try(func(attempt uint) error {
+		if attempt != 0 && isDebugMode {
+			log.Warnf("Attempt %d failed, retrying ...", attempt)
+		}
+
+		req, err := http.NewRequest(http.MethodGet, keysURL, nil)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode == http.StatusNotFound {
+			// not worth retrying
+			return nil
+		}
+		if resp.StatusCode != http.StatusOK {
+			return errors.Errorf("GET %s: unexpected status code: %d", keysURL, resp.StatusCode)
+		}
+
+		body, err = ioutil.ReadAll(resp.Body)
+		return errors.WithStack(err)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if body == nil {
+		return nil, errors.Errorf("GitHub user not found: %s", username)
+	}
+
+	keys, err := parseAuthorizedKeys(string(body))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Invalid SSH key published by GitHub user %s", username)
+	}
+	if len(keys) == 0 {
+		return nil, errors.Errorf("GitHub user %s has no SSH public key published", username)
+	}
+
+	for i := range keys {
+		keys[i].Comment = fmt.Sprintf("github:%s", username)
+	}
+	return keys, nil
+}
+
+// AddGitHubUsersAuthorizedKeys adds the SSH public keys published by the given GitHub users to the authorized_keys.
+func AddGitHubUsersAuthorizedKeys(ctx context.Context, authorizedKeysPth, baseURL string, usernames []string, restrictions AuthorizedKeyRestrictions) error {
+	var keys []AuthorizedKey
+	for _, username := range usernames {
+		log.Printf("Fetching SSH keys of GitHub user: %s", username)
+		userKeys, err := fetchGitHubUserKeys(ctx, baseURL, username)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, userKeys...)
+	}
+
+	return installAuthorizedKeys(authorizedKeysPth, keys, restrictions)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestFetchGitHubUserKeys(t *testing.T) {
+	keys := testSSHPublicKey + "\n" + testAuthorizedKeyLine(t, 1, "") + "\n"
+
+	var mu sync.Mutex
+	attempts := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		attempts[r.URL.Path]++
+		attempt := attempts[r.URL.Path]
+		mu.Unlock()
+
+		switch r.URL.Path {
+		case "/octocat.keys":
+			_, _ = w.Write([]byte(keys))
+		case "/flaky.keys":
+			if attempt == 1 {
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			_, _ = w.Write([]byte(keys))
+		case "/nokeys.keys":
+		case "/invalid.keys":
+			_, _ = w.Write([]byte(testSSHPublicKey + "\nnot a key\n"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		username     string
+		wantKeys     int
+		wantErr      string
+		wantAttempts int
+	}{
+		{username: "octocat", wantKeys: 2, wantAttempts: 1},
+		{username: "flaky", wantKeys: 2, wantAttempts: 2},
+		{username: "missing", wantErr: "GitHub user not found: missing", wantAttempts: 1},
+		{username: "nokeys", wantErr: "has no SSH public key published", wantAttempts: 1},
+		{username: "invalid", wantErr: "line 2", wantAttempts: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.username, func(t *testing.T) {
+			got, err := fetchGitHubUserKeys(context.Background(), server.URL+"/", tt.username)
+
+			mu.Lock()
+			gotAttempts := attempts["/"+tt.username+".keys"]
+			mu.Unlock()
+			if gotAttempts != tt.wantAttempts {
+				t.Errorf("unexpected number of requests: %d, want: %d", gotAttempts, tt.wantAttempts)
+			}
+
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected an error containing %q, got: %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if len(got) != tt.wantKeys {
+				t.Fatalf("unexpected number of keys: %d, want: %d", len(got), tt.wantKeys)
+			}
+			for _, key := range got {
+				if key.Comment != "github:"+tt.username {
+					t.Errorf("unexpected comment of %s: %s", key, key.Comment)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/bitrise-io/go-utils/fileutil"
+	"github.com/bitrise-io/go-utils/log"
+	"github.com/bitrise-steplib/steps-remote-access-macos-ngrok/internal/ngrokapi"
+	"github.com/pkg/errors"
+)
+
+const (
+	// the agent only keeps the latest requests, so those are polled frequently
+	harPollInterval  = 2 * time.Second
+	harArtifactName  = "ngrok-http-requests.har"
+	harRedactedValue = "[REDACTED]"
+)
+
+// httpRequestRecorder polls the requests recorded by the ngrok agent during the session,
+// and keeps every one of them, so those can be written into a HAR file at the end of the session.
+type httpRequestRecorder struct {
+	redactedHeaders map[string]bool
+
+	mu         sync.Mutex
+	requests   map[string]ngrokapi.Request
+	publicURLs map[string]string
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// startHTTPRequestRecorder starts polling the requests in the background,
+// the values of the given headers are redacted in the HAR file.
+func startHTTPRequestRecorder(redactedHeaders []string) *httpRequestRecorder {
+	recorder := newHTTPRequestRecorder(redactedHeaders)
+
+	go recorder.run()
+
+	return recorder
+}
+
+func newHTTPRequestRecorder(redactedHeaders []string) *httpRequestRecorder {
+	recorder := &httpRequestRecorder{
+		redactedHeaders: map[string]bool{},
+		requests:        map[string]ngrokapi.Request{},
+		publicURLs:      map[string]string{},
+		stop:            make(chan struct{}),
+		done:            make(chan struct{}),
+	}
+	for _, header := range redactedHeaders {
+		recorder.redactedHeaders[http.CanonicalHeaderKey(header)] = true
+	}
+	return recorder
+}
+
+func (recorder *httpRequestRecorder) run() {
+	defer close(recorder.done)
+
+	for {
+		recorder.poll()
+
+		select {
+		case <-recorder.stop:
+			return
+		case <-time.After(harPollInterval):
+		}
+	}
+}
+
+func (recorder *httpRequestRecorder) poll() {
+	ctx := context.Background()
+	requests, err := ngrokAPI.ListRequests(ctx)
+	if err != nil {
+		if isDebugMode {
+			log.Warnf("Failed to fetch HTTP requests: %s", err)
+		}
+		return
+	}
+	tunnels, err := ngrokAPI.ListTunnels(ctx)
+	if err != nil && isDebugMode {
+		log.Warnf("Failed to fetch tunnels: %s", err)
+	}
+
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+
+	for _, tunnel := range tunnels {
+		recorder.publicURLs[tunnel.Name] = tunnel.PublicURL
+	}
+	// a request is updated on every poll, as its response might not have been recorded yet
+	for _, request := range requests {
+		recorder.requests[request.ID] = request
+	}
+}
+
+// Stop stops polling, after fetching the requests recorded since the last poll.
+func (recorder *httpRequestRecorder) Stop() {
+	close(recorder.stop)
+	<-recorder.done
+	recorder.poll()
+}
+
+// WriteHAR writes the recorded requests, in the order those were started, as a HAR file into the deploy dir.
+// It returns the path of the HAR file and the number of requests written into it.
+func (recorder *httpRequestRecorder) WriteHAR() (string, int, error) {
+	deployDir := os.Getenv("BITRISE_DEPLOY_DIR")
+	if deployDir == "" {
+		return "", 0, errors.New("BITRISE_DEPLOY_DIR is not set")
+	}
+
+	recorder.mu.Lock()
+	var requests []ngrokapi.Request
+	for _, request := range recorder.requests {
+		requests = append(requests, request)
+	}
+	recorder.mu.Unlock()
+
+	sort.Slice(requests, func(i, j int) bool { return requests[i].Start.Before(requests[j].Start) })
+
+	har := harFile{}
+	har.Log.Version = "1.2"
+	har.Log.Creator = harCreator{Name: "steps-remote-access-macos-ngrok", Version: "1.0"}
+	har.Log.Entries = []harEntry{}
+	for _, request := range requests {
+		har.Log.Entries = append(har.Log.Entries, recorder.harEntry(request))
+	}
+
+	content, err := json.MarshalIndent(har, "", "  ")
+	if err != nil {
+		return "", 0, errors.WithStack(err)
+	}
+
+	pth := filepath.Join(deployDir, harArtifactName)
+	if err := fileutil.WriteBytesToFile(pth, content); err != nil {
+		return "", 0, errors.WithStack(err)
+	}
+	return pth, len(requests), nil
+}
+
+func (recorder *httpRequestRecorder) harEntry(captured ngrokapi.Request) harEntry {
+	entry := harEntry{
+		StartedDateTime: captured.Start,
+		Time:            durationMillis(captured.Duration),
+		Tunnel:          captured.TunnelName,
+		RemoteAddr:      captured.RemoteAddr,
+		Timings:         harTimings{Send: 0, Wait: durationMillis(captured.Duration), Receive: 0},
+	}
+
+	requestURL := recorder.requestURL(captured)
+	entry.Request = harRequest{
+		Method:      captured.Request.Method,
+		URL:         requestURL,
+		HTTPVersion: captured.Request.Proto,
+		Headers:     recorder.harHeaders(captured.Request.Headers),
+		QueryString: []harNameValue{},
+		Cookies:     []harNameValue{},
+		HeadersSize: -1,
+		BodySize:    -1,
+	}
+	if u, err := url.Parse(requestURL); err == nil {
+		entry.Request.QueryString = harNameValues(u.Query())
+	}
+	if body, ok := readRequestBody(captured.Request.Raw); ok {
+		entry.Request.BodySize = len(body)
+		if len(body) > 0 {
+			postData := &harPostData{MimeType: firstHeader(captured.Request.Headers, "Content-Type")}
+			postData.Text, postData.Encoding = harText(body)
+			entry.Request.PostData = postData
+		}
+	}
+
+	entry.Response = harResponse{
+		HTTPVersion: captured.Request.Proto,
+		Headers:     []harNameValue{},
+		Cookies:     []harNameValue{},
+		HeadersSize: -1,
+		BodySize:    -1,
+		Content:     harContent{Size: 0},
+	}
+	if captured.Response == nil {
+		entry.Comment = "no response recorded"
+		return entry
+	}
+
+	entry.Response.Status = captured.Response.StatusCode
+	entry.Response.StatusText = strings.TrimSpace(strings.TrimPrefix(captured.Response.Status, fmt.Sprint(captured.Response.StatusCode)))
+	entry.Response.HTTPVersion = captured.Response.Proto
+	entry.Response.Headers = recorder.harHeaders(captured.Response.Headers)
+	entry.Response.RedirectURL = firstHeader(captured.Response.Headers, "Location")
+	entry.Response.Content.MimeType = firstHeader(captured.Response.Headers, "Content-Type")
+	if body, ok := readResponseBody(captured.Response.Raw); ok {
+		entry.Response.BodySize = len(body)
+		entry.Response.Content.Size = len(body)
+		entry.Response.Content.Text, entry.Response.Content.Encoding = harText(body)
+	}
+	return entry
+}
+
+// requestURL returns the public URL of the request, based on the public URL of its tunnel,
+// or on the Host header if the tunnel is not known.
+func (recorder *httpRequestRecorder) requestURL(captured ngrokapi.Request) string {
+	recorder.mu.Lock()
+	publicURL := recorder.publicURLs[captured.TunnelName]
+	recorder.mu.Unlock()
+
+	if publicURL == "" {
+		publicURL = "http://" + firstHeader(captured.Request.Headers, "Host")
+	}
+	return strings.TrimSuffix(publicURL, "/") + captured.Request.URI
+}
+
+func (recorder *httpRequestRecorder) harHeaders(headers map[string][]string) []harNameValue {
+	redacted := http.Header{}
+	for name, values := range headers {
+		for _, value := range values {
+			if recorder.redactedHeaders[http.CanonicalHeaderKey(name)] {
+				value = harRedactedValue
+			}
+			redacted.Add(name, value)
+		}
+	}
+	return harNameValues(url.Values(redacted))
+}
+
+// readRequestBody returns the body of the raw request, ok is false if it could not be parsed.
+func readRequestBody(raw string) ([]byte, bool) {
+	content, err := base64.StdEncoding.DecodeString(raw)
+	if err != nil || len(content) == 0 {
+		return nil, false
+	}
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(content)))
+	if err != nil {
+		return nil, false
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, false
+	}
+	return body, true
+}
+
+// readResponseBody returns the body of the raw response, ok is false if it could not be parsed.
+func readResponseBody(raw string) ([]byte, bool) {
+	content, err := base64.StdEncoding.DecodeString(raw)
+	if err != nil || len(content) == 0 {
+		return nil, false
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(content)), nil)
+	if err != nil {
+		return nil, false
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, false
+	}
+	return body, true
+}
+
+// harText returns the body as text, base64 encoded if it is not valid UTF-8.
+func harText(body []byte) (text, encoding string) {
+	if utf8.Valid(body) {
+		return string(body), ""
+	}
+	return base64.StdEncoding.EncodeToString(body), "base64"
+}
+
+func harNameValues(values map[string][]string) []harNameValue {
+	var names []string
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	nameValues := []harNameValue{}
+	for _, name := range names {
+		for _, value := range values[name] {
+			nameValues = append(nameValues, harNameValue{Name: name, Value: value})
+		}
+	}
+	return nameValues
+}
+
+func firstHeader(headers map[string][]string, name string) string {
+	return http.Header(headers).Get(name)
+}
+
+func durationMillis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// HAR 1.2 format, see: http://www.softwareishard.com/blog/har-12-spec/
+type harFile struct {
+	Log struct {
+		Version string     `json:"version"`
+		Creator harCreator `json:"creator"`
+		Entries []harEntry `json:"entries"`
+	} `json:"log"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	Comment         string      `json:"comment,omitempty"`
+	// custom fields
+	Tunnel     string `json:"_tunnel,omitempty"`
+	RemoteAddr string `json:"_remoteAddr,omitempty"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	// custom field, the HAR format only defines the encoding of the response content
+	Encoding string `json:"_encoding,omitempty"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bitrise-steplib/steps-remote-access-macos-ngrok/internal/ngrokapi"
+)
+
+func rawHTTPMessage(message string) string {
+	return base64.StdEncoding.EncodeToString([]byte(message))
+}
+
+func TestWriteHAR(t *testing.T) {
+	deployDir := t.TempDir()
+	t.Setenv("BITRISE_DEPLOY_DIR", deployDir)
+
+	start := time.Date(2026, 10, 16, 12, 30, 0, 0, time.UTC)
+	recorder := newHTTPRequestRecorder([]string{"authorization", "Cookie", "Set-Cookie"})
+	recorder.publicURLs["web"] = "https://abcd.ngrok.io"
+	recorder.requests = map[string]ngrokapi.Request{
+		"second": {
+			ID:         "second",
+			TunnelName: "unknown",
+			Start:      start.Add(time.Second),
+			Request: ngrokapi.HTTPMessage{
+				Method:  "GET",
+				URI:     "/pending",
+				Proto:   "HTTP/1.1",
+				Headers: map[string][]string{"Host": {"efgh.ngrok.io"}},
+				Raw:     rawHTTPMessage("GET /pending HTTP/1.1\r\nHost: efgh.ngrok.io\r\n\r\n"),
+			},
+		},
+		"first": {
+			ID:         "first",
+			TunnelName: "web",
+			RemoteAddr: "1.2.3.4",
+			Start:      start,
+			Duration:   1500 * time.Millisecond,
+			Request: ngrokapi.HTTPMessage{
+				Method: "POST",
+				URI:    "/login?next=%2Fhome",
+				Proto:  "HTTP/1.1",
+				Headers: map[string][]string{
+					"Authorization": {"Bearer secret"},
+					"Cookie":        {"session=secret"},
+					"Content-Type":  {"application/json"},
+				},
+				Raw: rawHTTPMessage("POST /login?next=%2Fhome HTTP/1.1\r\nHost: abcd.ngrok.io\r\nContent-Type: application/json\r\nContent-Length: 17\r\n\r\n{\"user\":\"admin\"}\n"),
+			},
+			Response: &ngrokapi.HTTPMessage{
+				Status:     "302 Found",
+				StatusCode: 302,
+				Proto:      "HTTP/1.1",
+				Headers: map[string][]string{
+					"Set-Cookie":   {"session=secret"},
+					"Location":     {"/home"},
+					"Content-Type": {"application/octet-stream"},
+				},
+				Raw: rawHTTPMessage("HTTP/1.1 302 Found\r\nContent-Length: 3\r\n\r\n\xff\x00\xfe"),
+			},
+		},
+	}
+
+	pth, count, err := recorder.WriteHAR()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want := filepath.Join(deployDir, harArtifactName); pth != want {
+		t.Errorf("unexpected HAR path: %s, want: %s", pth, want)
+	}
+	if count != 2 {
+		t.Errorf("unexpected number of requests: %d, want: 2", count)
+	}
+
+	content, err := ioutil.ReadFile(pth)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	var har harFile
+	if err := json.Unmarshal(content, &har); err != nil {
+		t.Fatalf("invalid HAR JSON: %s", err)
+	}
+	if har.Log.Version != "1.2" {
+		t.Errorf("unexpected HAR version: %s", har.Log.Version)
+	}
+	if len(har.Log.Entries) != 2 {
+		t.Fatalf("unexpected number of entries: %d, want: 2", len(har.Log.Entries))
+	}
+
+	first := har.Log.Entries[0]
+	if first.Request.URL != "https://abcd.ngrok.io/login?next=%2Fhome" {
+		t.Errorf("unexpected request URL: %s", first.Request.URL)
+	}
+	if want := []harNameValue{{Name: "next", Value: "/home"}}; !reflect.DeepEqual(first.Request.QueryString, want) {
+		t.Errorf("unexpected query string: %v, want: %v", first.Request.QueryString, want)
+	}
+	wantRequestHeaders := []harNameValue{
+		{Name: "Authorization", Value: harRedactedValue},
+		{Name: "Content-Type", Value: "application/json"},
+		{Name: "Cookie", Value: harRedactedValue},
+	}
+	if !reflect.DeepEqual(first.Request.Headers, wantRequestHeaders) {
+		t.Errorf("unexpected request headers: %v, want: %v", first.Request.Headers, wantRequestHeaders)
+	}
+	if first.Request.PostData == nil || first.Request.PostData.Text != "{\"user\":\"admin\"}\n" || first.Request.PostData.Encoding != "" {
+		t.Errorf("unexpected request body: %+v", first.Request.PostData)
+	}
+	if first.Request.BodySize != 17 {
+		t.Errorf("unexpected request body size: %d, want: 17", first.Request.BodySize)
+	}
+
+	if first.Response.Status != 302 || first.Response.StatusText != "Found" || first.Response.RedirectURL != "/home" {
+		t.Errorf("unexpected response: %+v", first.Response)
+	}
+	wantResponseHeaders := []harNameValue{
+		{Name: "Content-Type", Value: "application/octet-stream"},
+		{Name: "Location", Value: "/home"},
+		{Name: "Set-Cookie", Value: harRedactedValue},
+	}
+	if !reflect.DeepEqual(first.Response.Headers, wantResponseHeaders) {
+		t.Errorf("unexpected response headers: %v, want: %v", first.Response.Headers, wantResponseHeaders)
+	}
+	wantContent := harContent{Size: 3, MimeType: "application/octet-stream", Text: base64.StdEncoding.EncodeToString([]byte("\xff\x00\xfe")), Encoding: "base64"}
+	if first.Response.Content != wantContent {
+		t.Errorf("unexpected response content: %+v, want: %+v", first.Response.Content, wantContent)
+	}
+	if first.Time != 1500 || first.Tunnel != "web" || first.RemoteAddr != "1.2.3.4" {
+		t.Errorf("unexpected entry: %+v", first)
+	}
+
+	second := har.Log.Entries[1]
+	if second.Request.URL != "http://efgh.ngrok.io/pending" {
+		t.Errorf("unexpected request URL: %s", second.Request.URL)
+	}
+	if second.Comment == "" || second.Response.Status != 0 {
+		t.Errorf("the entry without response should be commented: %+v", second)
+	}
+
+	requireHARFields(t, content)
+}
+
+// requireHARFields checks the fields required by the HAR 1.2 format.
+func requireHARFields(t *testing.T, content []byte) {
+	var har map[string]interface{}
+	if err := json.Unmarshal(content, &har); err != nil {
+		t.Fatalf("invalid HAR JSON: %s", err)
+	}
+
+	requireFields := func(name string, object interface{}, fields ...string) map[string]interface{} {
+		m, ok := object.(map[string]interface{})
+		if !ok {
+			t.Fatalf("%s should be an object: %v", name, object)
+		}
+		for _, field := range fields {
+			if _, ok := m[field]; !ok {
+				t.Errorf("%s misses the required field: %s", name, field)
+			}
+		}
+		return m
+	}
+
+	harLog := requireFields("log", har["log"], "version", "creator", "entries")
+	requireFields("creator", harLog["creator"], "name", "version")
+	entries, ok := harLog["entries"].([]interface{})
+	if !ok {
+		t.Fatalf("entries should be an array: %v", harLog["entries"])
+	}
+	for _, e := range entries {
+		entry := requireFields("entry", e, "startedDateTime", "time", "request", "response", "cache", "timings")
+		requireFields("request", entry["request"], "method", "url", "httpVersion", "cookies", "headers", "queryString", "headersSize", "bodySize")
+		response := requireFields("response", entry["response"], "status", "statusText", "httpVersion", "cookies", "headers", "content", "redirectURL", "headersSize", "bodySize")
+		requireFields("content", response["content"], "size", "mimeType")
+		requireFields("timings", entry["timings"], "send", "wait", "receive")
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+	"github.com/bitrise-io/go-utils/pathutil"
+	"github.com/bitrise-io/go-utils/retry"
+	"github.com/bitrise-io/go-utils/ziputil"
+	"github.com/pkg/errors"
+)
+
+const (
+	ngrokDefaultDownloadBaseURL = "https://bin.equinox.io/c/bNyj1mQVY4c"
+	// the archive of the latest stable agent, if no version is requested
+	ngrokStableChannel = "v3-stable"
+)
+
+// NgrokInstallOptions describe which ngrok agent to use, and where to get it from if it is not installed yet.
+type NgrokInstallOptions struct {
+	// Version is the requested agent version, any installed version is accepted if empty
+	Version         string
+	DownloadBaseURL string
+	// SHA256 is the expected checksum of the archive, not verified if empty
+	SHA256     string
+	InstallDir string
+}
+
+var (
+	ngrokPinnedVersionRegexp = regexp.MustCompile(`^\d+\.\d+\.\d+$`)
+	sha256Regexp             = regexp.MustCompile(`^[0-9a-fA-F]{64}$`)
+)
+
+func (options NgrokInstallOptions) validate() error {
+	if options.Version != "" && !ngrokPinnedVersionRegexp.MatchString(options.Version) {
+		return errors.Errorf("invalid version (%s), should be X.Y.Z, e.g. 3.5.0", options.Version)
+	}
+	if options.SHA256 != "" && !sha256Regexp.MatchString(options.SHA256) {
+		return errors.Errorf("invalid SHA-256 checksum (%s), should be 64 hex characters", options.SHA256)
+	}
+	if u, err := url.Parse(options.DownloadBaseURL); err != nil || u.Scheme == "" || u.Host == "" {
+		return errors.Errorf("invalid download base URL: %s", options.DownloadBaseURL)
+	}
+	// the official download location only hosts the latest stable agent
+	if options.Version != "" && strings.TrimSuffix(options.DownloadBaseURL, "/") == ngrokDefaultDownloadBaseURL {
+		return errors.Errorf("a pinned version (%s) can not be downloaded from the default download base URL, which only hosts the latest stable agent, specify a mirror as the download base URL", options.Version)
+	}
+	if !filepath.IsAbs(options.InstallDir) {
+		return errors.Errorf("invalid install dir (%s), should be an absolute path", options.InstallDir)
+	}
+	return nil
+}
+
+// ngrokArchiveName returns the name of the archive of the requested agent version:
+// ngrok-<version>-darwin-<arch>.zip, or ngrok-v3-stable-darwin-<arch>.zip if no version is requested.
+func ngrokArchiveName(version string) string {
+	if version == "" {
+		version = ngrokStableChannel
+	}
+	return fmt.Sprintf("ngrok-%s-darwin-%s.zip", version, runtime.GOARCH)
+}
+
+// ensureNgrok makes sure the requested ngrok agent is on the PATH: an already installed agent is used
+// if it matches the requested version, otherwise the agent is downloaded and installed into the install dir.
+func ensureNgrok(ctx context.Context, options NgrokInstallOptions) error {
+	if _, err := exec.LookPath("ngrok"); err == nil {
+		version, err := detectNgrokAgentVersion()
+		if err != nil {
+			log.Warnf("Failed to detect the version of the installed ngrok agent: %s", err)
+		} else if options.Version == "" || string(version) == options.Version {
+			log.Printf("Using the installed ngrok agent (%s)", version)
+			return nil
+		} else {
+			log.Printf("The installed ngrok agent (%s) does not match the requested version (%s)", version, options.Version)
+		}
+	}
+
+	if options.SHA256 == "" {
+		log.Warnf("No checksum specified for the ngrok archive, its integrity is not verified before it is installed")
+	}
+
+	if err := installNgrok(ctx, options); err != nil {
+		return err
+	}
+
+	if options.Version != "" {
+		version, err := detectNgrokAgentVersion()
+		if err != nil {
+			return err
+		}
+		if string(version) != options.Version {
+			return errors.Errorf("The installed ngrok agent version (%s) does not match the requested version (%s)", version, options.Version)
+		}
+	}
+	return nil
+}
+
+// installNgrok downloads the agent archive, verifies its checksum and unpacks the agent into the install dir,
+// which is then put on the PATH.
+func installNgrok(ctx context.Context, options NgrokInstallOptions) error {
+	tmpDir, err := pathutil.NormalizedOSTempDirPath("ngrok")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(tmpDir); err != nil {
+			log.Warnf("Failed to remove temporary directory: %s", err)
+		}
+	}()
+
+	archiveURL := strings.TrimSuffix(options.DownloadBaseURL, "/") + "/" + ngrokArchiveName(options.Version)
+	archivePth := filepath.Join(tmpDir, zipFile)
+	log.Printf("Downloading ngrok: %s", archiveURL)
+	checksum, err := downloadFile(ctx, archiveURL, archivePth)
+	if err != nil {
+		return errors.Wrap(err, "Failed to download ngrok")
+	}
+
+	if options.SHA256 != "" {
+		if !strings.EqualFold(checksum, options.SHA256) {
+			return errors.Errorf("Checksum mismatch of the ngrok archive (%s): expected %s, got %s", archiveURL, options.SHA256, checksum)
+		}
+		log.Printf("Checksum verified: %s", checksum)
+	} else {
+		log.Warnf("Checksum of the ngrok archive (not verified): %s", checksum)
+	}
+
+	unzipDir := filepath.Join(tmpDir, "unzipped")
+	if err := ziputil.UnZip(archivePth, unzipDir); err != nil {
+		return errors.Wrap(err, "Failed to unpack ngrok")
+	}
+	binPth := filepath.Join(unzipDir, "ngrok")
+	if exist, err := pathutil.IsPathExists(binPth); err != nil {
+		return errors.WithStack(err)
+	} else if !exist {
+		return errors.Errorf("No ngrok binary found in the archive (%s)", archiveURL)
+	}
+
+	if err := os.MkdirAll(options.InstallDir, 0755); err != nil && !os.IsPermission(err) {
+		return errors.WithStack(err)
+	}
+	// an already installed agent is replaced, it is restored at the end of the session
+	installedPth := filepath.Join(options.InstallDir, "ngrok")
+	if isDirWritable(options.InstallDir) {
+		if err := stepJournal.RecordFile(installedPth); err != nil {
+			return err
+		}
+		if err := newCommand("install", "-m", "0755", binPth, installedPth).Run(); err != nil {
+			return errors.Wrapf(err, "Failed to install ngrok into %s", options.InstallDir)
+		}
+	} else {
+		log.Printf("The install dir is not writable by the current user, installing ngrok with sudo ...")
+		if err := stepJournal.RecordRootFile(installedPth); err != nil {
+			return err
+		}
+		if err := newSudoCommand("install", "-d", "-m", "0755", options.InstallDir).Run(); err != nil {
+			return errors.Wrapf(err, "Failed to create the install dir (%s)", options.InstallDir)
+		}
+		if err := newSudoCommand("install", "-m", "0755", binPth, installedPth).Run(); err != nil {
+			return errors.Wrapf(err, "Failed to install ngrok into %s", options.InstallDir)
+		}
+	}
+	log.Donef("ngrok installed: %s", installedPth)
+
+	// startNgrokAsync looks up the agent on the PATH
+	return errors.WithStack(os.Setenv("PATH", options.InstallDir+string(os.PathListSeparator)+os.Getenv("PATH")))
+}
+
+// isDirWritable returns true if the current user is able to create files in the directory.
+func isDirWritable(dir string) bool {
+	f, err := ioutil.TempFile(dir, ".write-test")
+	if err != nil {
+		return false
+	}
+	if err := f.Close(); err != nil {
+		log.Warnf("Failed to close file: %s", err)
+	}
+	if err := os.Remove(f.Name()); err != nil {
+		log.Warnf("Failed to remove file: %s", err)
+	}
+	return true
+}
+
+// downloadFile downloads the URL to the given path and returns the hex encoded SHA-256 checksum of the content.
+func downloadFile(ctx context.Context, fileURL, pth string) (string, error) {
+	client := &http.Client{Timeout: 5 * time.Minute}
+
+	var checksum string
+	notFound := false
+	err := retry.Times(2).Wait(3 * time.Second).Try(func(attempt uint) error {
+		if attempt != 0 && isDebugMode {
+			log.Warnf("Attempt %d failed, retrying ...", attempt)
+		}
+
+		req, err := http.NewRequest(http.MethodGet, fileURL, nil)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode == http.StatusNotFound {
+			// not worth retrying
+			notFound = true
+			return nil
+		}
+		if resp.StatusCode != http.StatusOK {
+			return errors.Errorf("GET %s: unexpected status code: %d", fileURL, resp.StatusCode)
+		}
+
+		f, err := os.Create(pth)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		defer func() {
+			if err := f.Close(); err != nil {
+				log.Warnf("Failed to close file: %s", err)
+			}
+		}()
+
+		hash := sha256.New()
+		if _, err := io.Copy(io.MultiWriter(f, hash), resp.Body); err != nil {
+			return errors.WithStack(err)
+		}
+		checksum = hex.EncodeToString(hash.Sum(nil))
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if notFound {
+		return "", errors.Errorf("GET %s: not found", fileURL)
+	}
+	return checksum, nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNgrokInstallOptionsValidate(t *testing.T) {
+	const mirror = "https://mirror.example.com/ngrok"
+	const checksum = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+
+	tests := []struct {
+		name    string
+		options NgrokInstallOptions
+		wantErr bool
+	}{
+		{
+			name:    "latest stable agent from the default location",
+			options: NgrokInstallOptions{DownloadBaseURL: ngrokDefaultDownloadBaseURL, InstallDir: "/usr/local/bin"},
+		},
+		{
+			name:    "pinned version from a mirror",
+			options: NgrokInstallOptions{Version: "3.5.0", DownloadBaseURL: mirror, SHA256: checksum, InstallDir: "/usr/local/bin"},
+		},
+		{
+			name:    "pinned version from the default location",
+			options: NgrokInstallOptions{Version: "3.5.0", DownloadBaseURL: ngrokDefaultDownloadBaseURL + "/", InstallDir: "/usr/local/bin"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid version",
+			options: NgrokInstallOptions{Version: "v3", DownloadBaseURL: mirror, InstallDir: "/usr/local/bin"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid checksum",
+			options: NgrokInstallOptions{DownloadBaseURL: mirror, SHA256: "abcd", InstallDir: "/usr/local/bin"},
+			wantErr: true,
+		},
+		{
+			name:    "relative install dir",
+			options: NgrokInstallOptions{DownloadBaseURL: mirror, InstallDir: "bin"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.options.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("error: %v, wantErr: %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// zipArchive returns a zip archive of the given files.
+func zipArchive(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for name, content := range files {
+		f, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func checksumOf(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestInstallNgrok(t *testing.T) {
+	agentArchive := zipArchive(t, map[string]string{"ngrok": "#!/bin/sh\necho ngrok version 3.5.0\n"})
+	emptyArchive := zipArchive(t, map[string]string{"README": "no agent"})
+	notAnArchive := []byte("<html>not a zip</html>")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch path.Dir(r.URL.Path) {
+		case "/agent":
+			_, _ = w.Write(agentArchive)
+		case "/empty":
+			_, _ = w.Write(emptyArchive)
+		case "/garbage":
+			_, _ = w.Write(notAnArchive)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name    string
+		baseURL string
+		sha256  string
+		wantErr string
+	}{
+		{name: "verified archive", baseURL: server.URL + "/agent", sha256: checksumOf(agentArchive)},
+		{name: "unverified archive", baseURL: server.URL + "/agent"},
+		{name: "checksum mismatch", baseURL: server.URL + "/agent", sha256: checksumOf(notAnArchive), wantErr: "Checksum mismatch"},
+		{name: "not found", baseURL: server.URL + "/missing", wantErr: "not found"},
+		{name: "not an archive", baseURL: server.URL + "/garbage", wantErr: "Failed to unpack ngrok"},
+		{name: "no agent in the archive", baseURL: server.URL + "/empty", wantErr: "No ngrok binary found"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// installNgrok puts the install dir on the PATH
+			t.Setenv("PATH", os.Getenv("PATH"))
+			installDir := filepath.Join(t.TempDir(), "bin")
+
+			err := installNgrok(context.Background(), NgrokInstallOptions{
+				Version:         "3.5.0",
+				DownloadBaseURL: tt.baseURL,
+				SHA256:          tt.sha256,
+				InstallDir:      installDir,
+			})
+
+			installedPth := filepath.Join(installDir, "ngrok")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected an error containing %q, got: %v", tt.wantErr, err)
+				}
+				if _, err := os.Stat(installedPth); !os.IsNotExist(err) {
+					t.Errorf("expected no agent to be installed, got: %v", err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			info, err := os.Stat(installedPth)
+			if err != nil {
+				t.Fatalf("agent not installed: %s", err)
+			}
+			if info.Mode().Perm() != 0755 {
+				t.Errorf("unexpected agent permissions: %s", info.Mode().Perm())
+			}
+			if !strings.HasPrefix(os.Getenv("PATH"), installDir+string(os.PathListSeparator)) {
+				t.Errorf("the install dir is not put on the PATH: %s", os.Getenv("PATH"))
+			}
+		})
+	}
+}
+
+func TestInstallNgrokRestoresReplacedAgent(t *testing.T) {
+	agentArchive := zipArchive(t, map[string]string{"ngrok": "new agent"})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(agentArchive)
+	}))
+	defer server.Close()
+
+	t.Setenv("PATH", os.Getenv("PATH"))
+	installDir := t.TempDir()
+	installedPth := filepath.Join(installDir, "ngrok")
+	if err := ioutil.WriteFile(installedPth, []byte("own agent"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	journal, err := openJournal(filepath.Join(t.TempDir(), "journal.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stepJournal = journal
+	defer func() { stepJournal = nil }()
+
+	if err := installNgrok(context.Background(), NgrokInstallOptions{DownloadBaseURL: server.URL, InstallDir: installDir}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if content, err := ioutil.ReadFile(installedPth); err != nil || string(content) != "new agent" {
+		t.Fatalf("agent not replaced: %q, %v", content, err)
+	}
+
+	if err := journal.Rollback(); err != nil {
+		t.Fatalf("unexpected rollback error: %s", err)
+	}
+	if content, err := ioutil.ReadFile(installedPth); err != nil || string(content) != "own agent" {
+		t.Errorf("replaced agent not restored: %q, %v", content, err)
+	}
+}
@@ -0,0 +1,140 @@
+// Package ngrokapi is a client of the local API of the ngrok agent, served on the web_addr of the agent.
+package ngrokapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultTimeout is the default timeout of a single API call.
+const DefaultTimeout = 10 * time.Second
+
+// Client calls the local API of the ngrok agent.
+type Client struct {
+	baseURL    string
+	timeout    time.Duration
+	httpClient *http.Client
+}
+
+// New returns a client of the agent API served on the given base URL, e.g. http://localhost:4040.
+// Every call times out after the given timeout, DefaultTimeout is used if it is not positive.
+func New(baseURL string, timeout time.Duration) *Client {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	return &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		timeout:    timeout,
+		httpClient: &http.Client{},
+	}
+}
+
+// BaseURL returns the base URL of the agent API.
+func (client *Client) BaseURL() string {
+	return client.baseURL
+}
+
+// ListTunnels returns the running tunnels.
+func (client *Client) ListTunnels(ctx context.Context) ([]Tunnel, error) {
+	var resp struct {
+		Tunnels []Tunnel `json:"tunnels"`
+	}
+	if err := client.do(ctx, http.MethodGet, "/api/tunnels", nil, http.StatusOK, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Tunnels, nil
+}
+
+// GetTunnel returns the running tunnel of the given name.
+func (client *Client) GetTunnel(ctx context.Context, name string) (Tunnel, error) {
+	var tunnel Tunnel
+	if err := client.do(ctx, http.MethodGet, "/api/tunnels/"+url.PathEscape(name), nil, http.StatusOK, &tunnel); err != nil {
+		return Tunnel{}, err
+	}
+	return tunnel, nil
+}
+
+// StartTunnel starts a new tunnel and returns it.
+func (client *Client) StartTunnel(ctx context.Context, request StartTunnelRequest) (Tunnel, error) {
+	var tunnel Tunnel
+	if err := client.do(ctx, http.MethodPost, "/api/tunnels", request, http.StatusCreated, &tunnel); err != nil {
+		return Tunnel{}, err
+	}
+	return tunnel, nil
+}
+
+// StopTunnel stops the running tunnel of the given name.
+func (client *Client) StopTunnel(ctx context.Context, name string) error {
+	return client.do(ctx, http.MethodDelete, "/api/tunnels/"+url.PathEscape(name), nil, http.StatusNoContent, nil)
+}
+
+// ListRequests returns the requests recently recorded on the http tunnels,
+// the agent only keeps a limited number of the latest requests.
+func (client *Client) ListRequests(ctx context.Context) ([]Request, error) {
+	var resp struct {
+		Requests []Request `json:"requests"`
+	}
+	if err := client.do(ctx, http.MethodGet, "/api/requests/http", nil, http.StatusOK, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Requests, nil
+}
+
+// do sends the request, with the JSON encoded body if not nil, and decodes the JSON response into result if not nil.
+// An *Error is returned if the response status is not the expected one.
+func (client *Client) do(ctx context.Context, method, pth string, body interface{}, expectedStatus int, result interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, client.timeout)
+	defer cancel()
+
+	var reqBody io.Reader
+	if body != nil {
+		content, err := json.Marshal(body)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		reqBody = bytes.NewReader(content)
+	}
+
+	req, err := http.NewRequest(method, client.baseURL+pth, reqBody)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := client.httpClient.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "%s %s", method, pth)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expectedStatus {
+		apiErr := &Error{}
+		if content, err := ioutil.ReadAll(resp.Body); err == nil {
+			// the error body is informative only
+			_ = json.Unmarshal(content, apiErr)
+		}
+		apiErr.StatusCode = resp.StatusCode
+		return errors.Wrapf(apiErr, "%s %s", method, pth)
+	}
+
+	if result == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return errors.Wrapf(err, "%s %s: invalid response", method, pth)
+	}
+	return nil
+}
@@ -0,0 +1,286 @@
+package ngrokapi
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const tunnelsResponse = `{
+  "tunnels": [
+    {
+      "name": "ssh",
+      "uri": "/api/tunnels/ssh",
+      "public_url": "tcp://0.tcp.ngrok.io:12345",
+      "proto": "tcp",
+      "config": {"addr": "localhost:22", "inspect": false},
+      "metrics": {"conns": {"count": 3, "gauge": 1, "rate1": 0.5, "p50": 1000}, "http": {"count": 0}}
+    },
+    {
+      "name": "web",
+      "uri": "/api/tunnels/web",
+      "public_url": "https://abcd.ngrok.io",
+      "proto": "https",
+      "config": {"addr": "http://localhost:8080", "inspect": true},
+      "metrics": {"conns": {"count": 0, "gauge": 0}, "http": {"count": 7}}
+    }
+  ],
+  "uri": "/api/tunnels"
+}`
+
+func newTestServer(handler http.HandlerFunc) (*Client, func()) {
+	server := httptest.NewServer(handler)
+	return New(server.URL, time.Second), server.Close
+}
+
+func TestListTunnels(t *testing.T) {
+	client, closeServer := newTestServer(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.URL.Path != "/api/tunnels" {
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if _, err := w.Write([]byte(tunnelsResponse)); err != nil {
+			t.Error(err)
+		}
+	})
+	defer closeServer()
+
+	tunnels, err := client.ListTunnels(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(tunnels) != 2 {
+		t.Fatalf("expected 2 tunnels, got: %d", len(tunnels))
+	}
+
+	ssh := tunnels[0]
+	if ssh.Name != "ssh" || ssh.PublicURL != "tcp://0.tcp.ngrok.io:12345" || ssh.Proto != "tcp" {
+		t.Errorf("unexpected tunnel: %+v", ssh)
+	}
+	if ssh.Config.Addr != "localhost:22" || ssh.Config.Inspect {
+		t.Errorf("unexpected tunnel config: %+v", ssh.Config)
+	}
+	if ssh.Metrics.Conns.Count != 3 || ssh.Metrics.Conns.Gauge != 1 || ssh.Metrics.Conns.Rate1 != 0.5 {
+		t.Errorf("unexpected conn metrics: %+v", ssh.Metrics.Conns)
+	}
+	if tunnels[1].Metrics.HTTP.Count != 7 {
+		t.Errorf("unexpected http metrics: %+v", tunnels[1].Metrics.HTTP)
+	}
+}
+
+func TestGetTunnel(t *testing.T) {
+	client, closeServer := newTestServer(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/tunnels/web (http)":
+			if _, err := w.Write([]byte(`{"name": "web (http)", "public_url": "http://abcd.ngrok.io", "proto": "http"}`)); err != nil {
+				t.Error(err)
+			}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			if _, err := w.Write([]byte(`{"error_code": 100, "status_code": 404, "msg": "Tunnel not found", "details": {"err": "no such tunnel"}}`)); err != nil {
+				t.Error(err)
+			}
+		}
+	})
+	defer closeServer()
+
+	tunnel, err := client.GetTunnel(context.Background(), "web (http)")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if tunnel.Name != "web (http)" || tunnel.PublicURL != "http://abcd.ngrok.io" {
+		t.Errorf("unexpected tunnel: %+v", tunnel)
+	}
+
+	_, err = client.GetTunnel(context.Background(), "missing")
+	if !IsNotFound(err) {
+		t.Fatalf("expected a not found error, got: %v", err)
+	}
+	if want := "GET /api/tunnels/missing: ngrok API: 404 Tunnel not found (error code: 100): no such tunnel"; err.Error() != want {
+		t.Errorf("unexpected error message:\n got: %s\nwant: %s", err, want)
+	}
+}
+
+func TestStartTunnel(t *testing.T) {
+	client, closeServer := newTestServer(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/api/tunnels" {
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+		}
+		if contentType := r.Header.Get("Content-Type"); contentType != "application/json" {
+			t.Errorf("unexpected content type: %s", contentType)
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("failed to read the request body: %s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var request map[string]interface{}
+		if err := json.Unmarshal(body, &request); err != nil {
+			t.Errorf("invalid request body: %s", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		want := map[string]interface{}{"name": "inspector", "proto": "tcp", "addr": "9222"}
+		if len(request) != len(want) {
+			t.Errorf("unexpected request body: %s", body)
+		}
+		for key, value := range want {
+			if request[key] != value {
+				t.Errorf("unexpected %s: %v, request body: %s", key, request[key], body)
+			}
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		if _, err := w.Write([]byte(`{"name": "inspector", "public_url": "tcp://0.tcp.ngrok.io:23456", "proto": "tcp", "config": {"addr": "localhost:9222"}}`)); err != nil {
+			t.Error(err)
+		}
+	})
+	defer closeServer()
+
+	tunnel, err := client.StartTunnel(context.Background(), StartTunnelRequest{Name: "inspector", Proto: "tcp", Addr: "9222"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if tunnel.PublicURL != "tcp://0.tcp.ngrok.io:23456" {
+		t.Errorf("unexpected tunnel: %+v", tunnel)
+	}
+}
+
+func TestStartTunnelError(t *testing.T) {
+	client, closeServer := newTestServer(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		if _, err := w.Write([]byte(`{"error_code": 102, "status_code": 400, "msg": "invalid tunnel configuration", "details": {"err": "yaml: unmarshal errors"}}`)); err != nil {
+			t.Error(err)
+		}
+	})
+	defer closeServer()
+
+	_, err := client.StartTunnel(context.Background(), StartTunnelRequest{Name: "x", Proto: "tcp", Addr: "1"})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if IsNotFound(err) {
+		t.Errorf("unexpected not found error: %s", err)
+	}
+}
+
+func TestStopTunnel(t *testing.T) {
+	stopped := ""
+	client, closeServer := newTestServer(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			t.Errorf("unexpected method: %s", r.Method)
+		}
+		stopped = r.URL.Path
+		w.WriteHeader(http.StatusNoContent)
+	})
+	defer closeServer()
+
+	if err := client.StopTunnel(context.Background(), "ssh"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if stopped != "/api/tunnels/ssh" {
+		t.Errorf("unexpected tunnel stopped: %s", stopped)
+	}
+}
+
+func TestListRequests(t *testing.T) {
+	client, closeServer := newTestServer(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/requests/http" {
+			t.Errorf("unexpected path: %s", r.URL.Path)
+		}
+		if _, err := w.Write([]byte(`{
+  "uri": "/api/requests/http",
+  "requests": [
+    {
+      "uri": "/api/requests/http/548fb5c700000002",
+      "id": "548fb5c700000002",
+      "tunnel_name": "web",
+      "remote_addr": "192.168.100.25",
+      "start": "2014-12-02T16:38:10.106Z",
+      "duration": 3893202,
+      "request": {"method": "POST", "proto": "HTTP/1.1", "headers": {"Content-Type": ["application/json"]}, "uri": "/hook?x=1", "raw": "UE9TVCAvaG9vaw=="},
+      "response": {"status": "200 OK", "status_code": 200, "proto": "HTTP/1.1", "headers": {}, "raw": ""}
+    },
+    {
+      "id": "548fb5c700000003",
+      "tunnel_name": "web",
+      "start": "2014-12-02T16:38:11Z",
+      "request": {"method": "GET", "uri": "/"},
+      "response": null
+    }
+  ]
+}`)); err != nil {
+			t.Error(err)
+		}
+	})
+	defer closeServer()
+
+	requests, err := client.ListRequests(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(requests) != 2 {
+		t.Fatalf("expected 2 requests, got: %d", len(requests))
+	}
+
+	request := requests[0]
+	if request.ID != "548fb5c700000002" || request.TunnelName != "web" || request.Duration != 3893202*time.Nanosecond {
+		t.Errorf("unexpected request: %+v", request)
+	}
+	if request.Request.Method != "POST" || request.Request.URI != "/hook?x=1" || request.Request.Headers["Content-Type"][0] != "application/json" {
+		t.Errorf("unexpected request message: %+v", request.Request)
+	}
+	if request.Response == nil || request.Response.StatusCode != 200 {
+		t.Errorf("unexpected response: %+v", request.Response)
+	}
+	if requests[1].Response != nil {
+		t.Errorf("expected no response, got: %+v", requests[1].Response)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	client := New(server.URL, 50*time.Millisecond)
+	start := time.Now()
+	if _, err := client.ListTunnels(context.Background()); err == nil {
+		t.Fatal("expected a timeout error")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("the call did not time out in time: %s", elapsed)
+	}
+}
+
+func TestContextCancel(t *testing.T) {
+	client, closeServer := newTestServer(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("unexpected request")
+	})
+	defer closeServer()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := client.ListTunnels(ctx); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestBaseURL(t *testing.T) {
+	client := New("http://localhost:4041/", 0)
+	if client.BaseURL() != "http://localhost:4041" {
+		t.Errorf("unexpected base URL: %s", client.BaseURL())
+	}
+	if client.timeout != DefaultTimeout {
+		t.Errorf("unexpected timeout: %s", client.timeout)
+	}
+}
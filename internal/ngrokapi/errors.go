@@ -0,0 +1,36 @@
+package ngrokapi
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// Error is an error response of the agent API.
+type Error struct {
+	StatusCode int               `json:"status_code"`
+	ErrorCode  int               `json:"error_code"`
+	Msg        string            `json:"msg"`
+	Details    map[string]string `json:"details"`
+}
+
+func (e *Error) Error() string {
+	msg := e.Msg
+	if msg == "" {
+		msg = http.StatusText(e.StatusCode)
+	}
+	if e.ErrorCode != 0 {
+		msg = fmt.Sprintf("%s (error code: %d)", msg, e.ErrorCode)
+	}
+	if details := e.Details["err"]; details != "" {
+		msg += ": " + details
+	}
+	return fmt.Sprintf("ngrok API: %d %s", e.StatusCode, msg)
+}
+
+// IsNotFound returns true if the error is a not found response of the agent API.
+func IsNotFound(err error) bool {
+	apiErr, ok := errors.Cause(err).(*Error)
+	return ok && apiErr.StatusCode == http.StatusNotFound
+}
@@ -0,0 +1,98 @@
+package ngrokapi
+
+import "time"
+
+// ConnMetrics are the connection metrics of a tunnel.
+type ConnMetrics struct {
+	Count  int     `json:"count"`
+	Gauge  int     `json:"gauge"`
+	Rate1  float64 `json:"rate1"`
+	Rate5  float64 `json:"rate5"`
+	Rate15 float64 `json:"rate15"`
+	P50    float64 `json:"p50"`
+	P90    float64 `json:"p90"`
+	P95    float64 `json:"p95"`
+	P99    float64 `json:"p99"`
+}
+
+// HTTPMetrics are the request metrics of an http tunnel.
+type HTTPMetrics struct {
+	Count  int     `json:"count"`
+	Rate1  float64 `json:"rate1"`
+	Rate5  float64 `json:"rate5"`
+	Rate15 float64 `json:"rate15"`
+	P50    float64 `json:"p50"`
+	P90    float64 `json:"p90"`
+	P95    float64 `json:"p95"`
+	P99    float64 `json:"p99"`
+}
+
+// TunnelMetrics ...
+type TunnelMetrics struct {
+	Conns ConnMetrics `json:"conns"`
+	HTTP  HTTPMetrics `json:"http"`
+}
+
+// TunnelConfig is the local side of a tunnel.
+type TunnelConfig struct {
+	Addr    string `json:"addr"`
+	Inspect bool   `json:"inspect"`
+}
+
+// Tunnel is a running tunnel of the agent.
+type Tunnel struct {
+	Name      string        `json:"name"`
+	URI       string        `json:"uri"`
+	PublicURL string        `json:"public_url"`
+	Proto     string        `json:"proto"`
+	Config    TunnelConfig  `json:"config"`
+	Metrics   TunnelMetrics `json:"metrics"`
+}
+
+// StartTunnelRequest describes a tunnel to start, the fields are the same as the ones of a tunnel
+// in the agent config. Auth and BindTLS are only understood by the v2 agent, Domain, BasicAuth
+// and Schemes only by the v3 agent.
+type StartTunnelRequest struct {
+	Name       string `json:"name"`
+	Proto      string `json:"proto"`
+	Addr       string `json:"addr"`
+	Subdomain  string `json:"subdomain,omitempty"`
+	Hostname   string `json:"hostname,omitempty"`
+	RemoteAddr string `json:"remote_addr,omitempty"`
+	HostHeader string `json:"host_header,omitempty"`
+	Inspect    *bool  `json:"inspect,omitempty"`
+
+	// v2 agent
+	Auth    string      `json:"auth,omitempty"`
+	BindTLS interface{} `json:"bind_tls,omitempty"`
+
+	// v3 agent
+	Domain    string   `json:"domain,omitempty"`
+	BasicAuth []string `json:"basic_auth,omitempty"`
+	Schemes   []string `json:"schemes,omitempty"`
+}
+
+// HTTPMessage is a request or response recorded by the agent.
+type HTTPMessage struct {
+	Method     string              `json:"method"`
+	URI        string              `json:"uri"`
+	Status     string              `json:"status"`
+	StatusCode int                 `json:"status_code"`
+	Proto      string              `json:"proto"`
+	Headers    map[string][]string `json:"headers"`
+	// Raw is the base64 encoded raw HTTP message, including the body
+	Raw string `json:"raw"`
+}
+
+// Request is a round trip recorded by the agent on an http tunnel.
+type Request struct {
+	ID         string        `json:"id"`
+	URI        string        `json:"uri"`
+	TunnelName string        `json:"tunnel_name"`
+	RemoteAddr string        `json:"remote_addr"`
+	Start      time.Time     `json:"start"`
+	Duration   time.Duration `json:"duration"`
+	Request    HTTPMessage   `json:"request"`
+	// Response is nil until the response is recorded
+	Response *HTTPMessage `json:"response"`
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/bitrise-io/go-utils/fileutil"
+	"github.com/bitrise-io/go-utils/log"
+	"github.com/bitrise-io/go-utils/pathutil"
+	"github.com/pkg/errors"
+)
+
+// journal entry kinds
+const (
+	journalEntryFile             = "file"
+	journalEntryRootFile         = "root_file"
+	journalEntryUserPassword     = "user_password"
+	journalEntryKeychainPassword = "keychain_password"
+	journalEntryRemoteDesktop    = "remote_desktop"
+	journalEntryUser             = "user"
+)
+
+// stepJournal records the system mutations of the current run, nil if journaling is disabled.
+var stepJournal *Journal
+
+// JournalEntry describes a single system mutation with everything required to undo it.
+type JournalEntry struct {
+	Kind string    `json:"kind"`
+	Time time.Time `json:"time"`
+
+	// file, root_file and keychain_password entries
+	Path    string      `json:"path,omitempty"`
+	Existed bool        `json:"existed,omitempty"`
+	Mode    os.FileMode `json:"mode,omitempty"`
+	Content []byte      `json:"content,omitempty"`
+
+	// user and user_password entries
+	Username string `json:"username,omitempty"`
+
+	// user_password and keychain_password entries, the passwords are only kept in memory,
+	// so those can not be restored from a journal left behind by a crashed run
+	OldPassword string `json:"-"`
+	NewPassword string `json:"-"`
+
+	// remote_desktop entries
+	WasActive bool `json:"was_active,omitempty"`
+}
+
+func (entry JournalEntry) String() string {
+	switch entry.Kind {
+	case journalEntryFile, journalEntryRootFile, journalEntryKeychainPassword:
+		return fmt.Sprintf("%s (%s)", entry.Kind, entry.Path)
+	case journalEntryUser, journalEntryUserPassword:
+		return fmt.Sprintf("%s (%s)", entry.Kind, entry.Username)
+	default:
+		return entry.Kind
+	}
+}
+
+// Journal is a persistent, append only log of the system mutations performed by the step.
+// Every mutation is recorded before it happens, so a journal left behind by a crashed run
+// can still be rolled back.
+type Journal struct {
+	path    string
+	Entries []JournalEntry `json:"entries"`
+}
+
+// openJournal loads the journal from the given path, or returns an empty one if it does not exist yet.
+func openJournal(pth string) (*Journal, error) {
+	journal := &Journal{path: pth}
+
+	content, err := ioutil.ReadFile(pth)
+	if os.IsNotExist(err) {
+		return journal, nil
+	} else if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if err := json.Unmarshal(content, journal); err != nil {
+		return nil, errors.Wrapf(err, "Failed to parse journal (%s)", pth)
+	}
+	return journal, nil
+}
+
+// Record appends the entry to the journal and persists it.
+func (journal *Journal) Record(entry JournalEntry) error {
+	if journal == nil {
+		return nil
+	}
+
+	entry.Time = time.Now()
+	journal.Entries = append(journal.Entries, entry)
+	if err := journal.save(); err != nil {
+		return errors.Wrapf(err, "Failed to record %s in the journal", entry)
+	}
+	return nil
+}
+
+// RecordFile backs up the given file before it is modified.
+func (journal *Journal) RecordFile(pth string) error {
+	entry := JournalEntry{Kind: journalEntryFile, Path: pth}
+
+	info, err := os.Stat(pth)
+	if err == nil {
+		content, err := ioutil.ReadFile(pth)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		entry.Existed = true
+		entry.Mode = info.Mode().Perm()
+		entry.Content = content
+	} else if !os.IsNotExist(err) {
+		return errors.WithStack(err)
+	}
+
+	return journal.Record(entry)
+}
+
+// RecordRootFile backs up the given file, only readable by root, before it is modified.
+func (journal *Journal) RecordRootFile(pth string) error {
+	entry := JournalEntry{Kind: journalEntryRootFile, Path: pth}
+
+	info, err := os.Stat(pth)
+	if err == nil {
+		content, err := newSudoCommand("cat", pth).GetCmd().Output()
+		if err != nil {
+			return errors.Wrapf(err, "Failed to read %s", pth)
+		}
+		entry.Existed = true
+		entry.Mode = info.Mode().Perm()
+		entry.Content = content
+	} else if !os.IsNotExist(err) {
+		return errors.WithStack(err)
+	}
+
+	return journal.Record(entry)
+}
+
+// IsEmpty ...
+func (journal *Journal) IsEmpty() bool {
+	return journal == nil || len(journal.Entries) == 0
+}
+
+// Rollback undoes the recorded mutations in reverse order.
+// Successfully undone entries are removed from the journal, the journal file itself is removed
+// once every entry is undone.
+func (journal *Journal) Rollback() error {
+	if journal.IsEmpty() {
+		return nil
+	}
+
+	var failed []JournalEntry
+	for i := len(journal.Entries) - 1; i >= 0; i-- {
+		entry := journal.Entries[i]
+		log.Printf("Undo %s", entry)
+		if err := undoJournalEntry(entry); err != nil {
+			log.Errorf("Failed to undo %s: %s", entry, err)
+			failed = append([]JournalEntry{entry}, failed...)
+		}
+	}
+
+	journal.Entries = failed
+	if len(failed) > 0 {
+		if err := journal.save(); err != nil {
+			log.Warnf("Failed to update journal: %s", err)
+		}
+		return errors.Errorf("Failed to undo %d system change(s), the journal is kept at: %s", len(failed), journal.path)
+	}
+
+	if err := os.Remove(journal.path); err != nil && !os.IsNotExist(err) {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+func (journal *Journal) save() error {
+	content, err := json.MarshalIndent(journal, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if err := pathutil.EnsureDirExist(filepath.Dir(journal.path)); err != nil {
+		return errors.WithStack(err)
+	}
+
+	// write and rename, so a crash never leaves a truncated journal behind
+	tmpPth := journal.path + ".tmp"
+	if err := fileutil.WriteBytesToFileWithPermission(tmpPth, content, 0600); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(tmpPth, journal.path))
+}
+
+func undoJournalEntry(entry JournalEntry) error {
+	switch entry.Kind {
+	case journalEntryFile:
+		if !entry.Existed {
+			if err := os.Remove(entry.Path); err != nil && !os.IsNotExist(err) {
+				return errors.WithStack(err)
+			}
+			return nil
+		}
+		return errors.WithStack(fileutil.WriteBytesToFileWithPermission(entry.Path, entry.Content, entry.Mode))
+	case journalEntryRootFile:
+		return restoreRootFile(entry)
+	case journalEntryUserPassword:
+		if entry.OldPassword == "" {
+			log.Warnf("The previous password of user %s is unknown, it can not be restored", entry.Username)
+			return nil
+		}
+		return newSudoCommand("dscl", ".", "-passwd", "/Users/"+entry.Username, entry.OldPassword).Run()
+	case journalEntryKeychainPassword:
+		if entry.OldPassword == "" || entry.NewPassword == "" {
+			log.Warnf("The previous password of the keychain (%s) is unknown, it can not be restored", entry.Path)
+			return nil
+		}
+		return changeKeychainPassword(entry.Path, entry.NewPassword, entry.OldPassword)
+	case journalEntryRemoteDesktop:
+		return restoreRemoteDesktop(entry.WasActive)
+	case journalEntryUser:
+		return deleteTemporaryUser(entry.Username)
+	default:
+		return errors.Errorf("Unknown journal entry kind: %s", entry.Kind)
+	}
+}
+
+func restoreRootFile(entry JournalEntry) error {
+	if !entry.Existed {
+		return newSudoCommand("rm", "-f", entry.Path).Run()
+	}
+	return writeRootFile(entry.Path, entry.Content, entry.Mode)
+}
+
+// writeRootFile writes the file, owned by root, with the given permissions.
+func writeRootFile(pth string, content []byte, mode os.FileMode) error {
+	tmpFile, err := ioutil.TempFile("", "root-file")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer func() {
+		if err := os.Remove(tmpFile.Name()); err != nil {
+			log.Warnf("Failed to remove temporary file: %s", err)
+		}
+	}()
+
+	if _, err := tmpFile.Write(content); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+
+	return newSudoCommand("install", "-m", fmt.Sprintf("%o", mode), "-o", "root", "-g", "wheel", tmpFile.Name(), pth).Run()
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestJournal(t *testing.T) (*Journal, string) {
+	dir := t.TempDir()
+	journal, err := openJournal(filepath.Join(dir, "journal", "journal.json"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return journal, dir
+}
+
+func writeTestFile(t *testing.T, pth, content string) {
+	if err := ioutil.WriteFile(pth, []byte(content), 0600); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+func recordTestFile(t *testing.T, journal *Journal, pth string) {
+	if err := journal.RecordFile(pth); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+func requireFileContent(t *testing.T, pth, want string) {
+	content, err := ioutil.ReadFile(pth)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(content) != want {
+		t.Errorf("unexpected content of %s: %q, want: %q", pth, content, want)
+	}
+}
+
+func requireFileNotExist(t *testing.T, pth string) {
+	if _, err := os.Stat(pth); !os.IsNotExist(err) {
+		t.Errorf("%s should not exist, stat error: %v", pth, err)
+	}
+}
+
+func TestJournalRollback(t *testing.T) {
+	journal, dir := newTestJournal(t)
+
+	modifiedPth := filepath.Join(dir, "modified")
+	writeTestFile(t, modifiedPth, "original")
+	if err := os.Chmod(modifiedPth, 0640); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	recordTestFile(t, journal, modifiedPth)
+	writeTestFile(t, modifiedPth, "modified")
+
+	newPth := filepath.Join(dir, "new")
+	recordTestFile(t, journal, newPth)
+	writeTestFile(t, newPth, "new")
+
+	if err := journal.Rollback(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	requireFileContent(t, modifiedPth, "original")
+	if info, err := os.Stat(modifiedPth); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if info.Mode().Perm() != 0640 {
+		t.Errorf("unexpected mode of %s: %s, want: %s", modifiedPth, info.Mode().Perm(), os.FileMode(0640))
+	}
+	requireFileNotExist(t, newPth)
+	requireFileNotExist(t, journal.path)
+	if !journal.IsEmpty() {
+		t.Errorf("journal should be empty, entries: %v", journal.Entries)
+	}
+}
+
+func TestJournalRollbackReverseOrder(t *testing.T) {
+	journal, dir := newTestJournal(t)
+
+	// the file is created and then modified, undoing in recording order would leave the first version behind
+	pth := filepath.Join(dir, "file")
+	recordTestFile(t, journal, pth)
+	writeTestFile(t, pth, "first")
+	recordTestFile(t, journal, pth)
+	writeTestFile(t, pth, "second")
+
+	if err := journal.Rollback(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	requireFileNotExist(t, pth)
+}
+
+func TestJournalRollbackKeepsFailedEntries(t *testing.T) {
+	journal, dir := newTestJournal(t)
+
+	pth := filepath.Join(dir, "file")
+	recordTestFile(t, journal, pth)
+	writeTestFile(t, pth, "new")
+
+	failingEntry := JournalEntry{Kind: "unknown"}
+	if err := journal.Record(failingEntry); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if err := journal.Rollback(); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	requireFileNotExist(t, pth)
+	if len(journal.Entries) != 1 || journal.Entries[0].Kind != failingEntry.Kind {
+		t.Errorf("only the failed entry should be kept, entries: %v", journal.Entries)
+	}
+
+	persisted, err := openJournal(journal.path)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(persisted.Entries) != 1 || persisted.Entries[0].Kind != failingEntry.Kind {
+		t.Errorf("only the failed entry should be kept in the journal file, entries: %v", persisted.Entries)
+	}
+}
+
+func TestJournalRollbackFromFile(t *testing.T) {
+	journal, dir := newTestJournal(t)
+
+	modifiedPth := filepath.Join(dir, "modified")
+	writeTestFile(t, modifiedPth, "original")
+	recordTestFile(t, journal, modifiedPth)
+	writeTestFile(t, modifiedPth, "modified")
+
+	newPth := filepath.Join(dir, "new")
+	recordTestFile(t, journal, newPth)
+	writeTestFile(t, newPth, "new")
+
+	if err := journal.Record(JournalEntry{Kind: journalEntryUserPassword, Username: "vagrant", OldPassword: "old", NewPassword: "new"}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// a crashed run leaves only the journal file behind
+	replayed, err := openJournal(journal.path)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(replayed.Entries) != 3 {
+		t.Fatalf("unexpected journal entries: %v", replayed.Entries)
+	}
+	if entry := replayed.Entries[2]; entry.OldPassword != "" || entry.NewPassword != "" {
+		t.Errorf("passwords should not be persisted: %#v", entry)
+	}
+
+	// the unknown previous password is only warned about
+	if err := replayed.Rollback(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	requireFileContent(t, modifiedPth, "original")
+	requireFileNotExist(t, newPth)
+	requireFileNotExist(t, journal.path)
+}
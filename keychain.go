@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// loginKeychainPath returns the path of the login keychain of the current user.
+func loginKeychainPath() (string, error) {
+	out, err := newCommand("security", "login-keychain").RunAndReturnTrimmedOutput()
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to find the login keychain: %s", out)
+	}
+	pth := strings.Trim(out, `" `)
+	if pth == "" {
+		return "", errors.New("No login keychain found")
+	}
+	return pth, nil
+}
+
+// changeKeychainPassword changes the password of the keychain, then unlocks it with the new password.
+func changeKeychainPassword(keychainPth, oldPassword, newPassword string) error {
+	if err := setKeychainPassword(keychainPth, oldPassword, newPassword); err != nil {
+		return err
+	}
+	return unlockKeychain(keychainPth, newPassword)
+}
+
+// setKeychainPassword changes the password of the keychain.
+func setKeychainPassword(keychainPth, oldPassword, newPassword string) error {
+	if out, err := newCommand("security", "set-keychain-password", "-o", oldPassword, "-p", newPassword, keychainPth).RunAndReturnTrimmedCombinedOutput(); err != nil {
+		return errors.Wrapf(err, "Failed to change the password of the keychain (%s): %s", keychainPth, out)
+	}
+	return nil
+}
+
+// unlockKeychain unlocks the keychain with the given password.
+func unlockKeychain(keychainPth, password string) error {
+	if out, err := newCommand("security", "unlock-keychain", "-p", password, keychainPth).RunAndReturnTrimmedCombinedOutput(); err != nil {
+		return errors.Wrapf(err, "Failed to unlock the keychain (%s): %s", keychainPth, out)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	generatedSSHKeyOutputKey    = "REMOTE_ACCESS_SSH_PRIVATE_KEY"
+	generatedSSHKeyArtifactName = "remote-access-ssh-key"
+)
+
+// generateSSHKeyPair generates an ed25519 key pair, returns the public key in authorized_keys format
+// and the private key in OpenSSH PEM format.
+func generateSSHKeyPair(comment string) (string, []byte, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", nil, errors.WithStack(err)
+	}
+
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return "", nil, errors.WithStack(err)
+	}
+	authorizedKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPub))) + " " + comment
+
+	block, err := ssh.MarshalPrivateKey(priv, comment)
+	if err != nil {
+		return "", nil, errors.WithStack(err)
+	}
+	return authorizedKey, pem.EncodeToMemory(block), nil
+}
+
+func generatedSSHKeyComment() string {
+	if buildSlug := os.Getenv("BITRISE_BUILD_SLUG"); buildSlug != "" {
+		return "remote-access-" + buildSlug
+	}
+	return fmt.Sprintf("remote-access-%d", time.Now().Unix())
+}
+
+// AddGeneratedAuthorizedKey generates a one-time SSH key pair, authorizes its public key
+// and exports its private key as a sensitive step output.
+// If a recipient is specified, the private key is also written into the deploy dir, encrypted to the recipient.
+func AddGeneratedAuthorizedKey(authorizedKeysPth string, restrictions AuthorizedKeyRestrictions, recipient string) error {
+	publicKey, privateKey, err := generateSSHKeyPair(generatedSSHKeyComment())
+	if err != nil {
+		return errors.Wrap(err, "Failed to generate SSH key pair")
+	}
+
+	if err := AddAuthorizedKey(authorizedKeysPth, publicKey, restrictions); err != nil {
+		return err
+	}
+
+	if err := exportSensitiveOutput(generatedSSHKeyOutputKey, string(privateKey)); err != nil {
+		return errors.Wrapf(err, "Failed to export %s", generatedSSHKeyOutputKey)
+	}
+	log.Printf("The private key is exported as $%s", generatedSSHKeyOutputKey)
+
+	if recipient != "" {
+		pth, err := writeEncryptedArtifact(recipient, generatedSSHKeyArtifactName, privateKey)
+		if err != nil {
+			return errors.Wrap(err, "Failed to write the encrypted private key")
+		}
+		log.Printf("The encrypted private key is written to: %s", pth)
+	}
+
+	return nil
+}
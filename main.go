@@ -1,17 +1,15 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	"net/http"
 	"net/url"
 	"os"
 	"os/user"
-	"time"
+	"sort"
+	"strings"
 
-	"github.com/bitrise-io/go-utils/retry"
-
-	"github.com/bitrise-io/go-utils/fileutil"
+	"github.com/bitrise-io/go-utils/pathutil"
 
 	"github.com/bitrise-io/go-utils/command"
 	"github.com/bitrise-io/go-utils/log"
@@ -19,154 +17,198 @@ import (
 )
 
 const (
-	authorizedKeysFilePath = "$HOME/.ssh/authorized_keys"
-	kickstart              = "/System/Library/CoreServices/RemoteManagement/ARDAgent.app/Contents/Resources/kickstart"
-	zipFile                = "ngrok.zip"
-	dir                    = "/usr/local/bin"
-	ngrokFile              = "/tmp/ngrok-config.yml"
+	kickstart         = "/System/Library/CoreServices/RemoteManagement/ARDAgent.app/Contents/Resources/kickstart"
+	zipFile           = "ngrok.zip"
+	dir               = "/usr/local/bin"
+	ngrokFile         = "/tmp/ngrok-config.yml"
+	ardActivationFile = "/Library/Application Support/Apple/Remote Desktop/RemoteManagement.launchd"
+)
+
+// screen sharing privilege profiles
+const (
+	screenSharePrivilegesObserve = "observe"
+	screenSharePrivilegesControl = "control"
+	screenSharePrivilegesFull    = "full"
 )
 
 var (
 	isDebugMode = false
+
+	// kickstart -privs flags of the screen sharing privilege profiles
+	screenSharePrivileges = map[string][]string{
+		screenSharePrivilegesObserve: {"-ControlObserve", "-ObserveOnly", "-ShowObserve"},
+		screenSharePrivilegesControl: {"-ControlObserve", "-ShowObserve", "-TextMessages", "-OpenQuitApps", "-GenerateReports", "-RestartShutDown", "-ChangeSettings"},
+		screenSharePrivilegesFull:    {"-all"},
+	}
+
+	// settings files changed by kickstart
+	ardSettingsFiles = []string{
+		"/Library/Preferences/com.apple.RemoteManagement.plist",
+		"/Library/Preferences/com.apple.VNCSettings.txt",
+	}
 )
 
-// NgrokTunnelConfig ...
-type NgrokTunnelConfig struct {
-	Addr  int    `json:"addr,omitempty"`
-	Proto string `json:"proto,omitempty"`
+func newCommand(name string, args ...string) *command.Model {
+	cmd := command.New(name, args...)
+	if isDebugMode {
+		log.Infof("\n$ %s\n", cmd.PrintableCommandArgs())
+	}
+	return cmd
 }
 
-// NgrokConfig ...
-type NgrokConfig struct {
-	Authtoken string                       `json:"authtoken,omitempty"`
-	Tunnels   map[string]NgrokTunnelConfig `json:"tunnels,omitempty"`
+func newSudoCommand(args ...string) *command.Model {
+	return newCommand("sudo", args...)
 }
 
-// AddAuthorizedKey ...
-func AddAuthorizedKey(sshKey string) error {
-	f, err := os.OpenFile(os.ExpandEnv(authorizedKeysFilePath), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+// AddAuthorizedKey adds the newline separated SSH public keys to the authorized_keys,
+// keys which are already authorized are skipped.
+func AddAuthorizedKey(authorizedKeysPth, sshKey string, restrictions AuthorizedKeyRestrictions) error {
+	keys, err := parseAuthorizedKeys(sshKey)
 	if err != nil {
-		return fmt.Errorf("Can't open file (%s), error: %v", authorizedKeysFilePath, err)
+		return errors.Wrap(err, "Invalid SSH Public Key")
+	}
+	return installAuthorizedKeys(authorizedKeysPth, keys, restrictions)
+}
+
+// EnableRemoteDesktop enables screen sharing with the given VNC password and privilege profile.
+func EnableRemoteDesktop(password, privilegeProfile string) error {
+	privileges, ok := screenSharePrivileges[privilegeProfile]
+	if !ok {
+		return errors.Errorf("Unknown screen sharing privilege profile: %s", privilegeProfile)
 	}
-	defer func() {
-		if err := f.Close(); err != nil {
-			panic(err)
-		}
-	}()
 
-	if _, err = f.WriteString(fmt.Sprintf("\n%s\n", sshKey)); err != nil {
-		return fmt.Errorf("Can't write SSH Public Key, error: %v", err)
+	if err := recordRemoteDesktopState(); err != nil {
+		return err
 	}
-	return err
+
+	args := []string{kickstart, "-activate", "-configure", "-access", "-on", "-clientopts", "-setvnclegacy", "-vnclegacy", "yes", "-clientopts", "-setvncpw", "-vncpw", password, "-restart", "-agent", "-privs"}
+	args = append(args, privileges...)
+	return newSudoCommand(args...).Run()
 }
 
-// EnableRemoteDesktop ...
-func EnableRemoteDesktop(password string) error {
-	args := []string{kickstart, "-activate", "-configure", "-access", "-on", "-clientopts", "-setvnclegacy", "-vnclegacy", "yes", "-clientopts", "-setvncpw", "-vncpw", password, "-restart", "-agent", "-privs", "-all"}
-	cmd := command.New("sudo", args...)
-	if isDebugMode {
-		log.Infof("\n$ %s\n", cmd.PrintableCommandArgs())
+func isRemoteDesktopActive() (bool, error) {
+	if exist, err := pathutil.IsPathExists(ardActivationFile); err != nil {
+		return false, errors.WithStack(err)
+	} else if !exist {
+		return false, nil
 	}
-	return cmd.Run()
+
+	out, err := newSudoCommand("cat", ardActivationFile).RunAndReturnTrimmedOutput()
+	if err != nil {
+		return false, errors.Wrapf(err, "Failed to read %s", ardActivationFile)
+	}
+	return out == "enabled", nil
 }
 
-// ChangeUserPassword ...
-func ChangeUserPassword(changePasswordTo string) error {
-	user, err := user.Current()
+// recordRemoteDesktopState journals the prior ARD activation state and settings files.
+func recordRemoteDesktopState() error {
+	if stepJournal == nil {
+		return nil
+	}
+
+	wasActive, err := isRemoteDesktopActive()
 	if err != nil {
-		return errors.WithStack(err)
+		return err
+	}
+	// recorded before the settings files, so on rollback the files are restored first
+	if err := stepJournal.Record(JournalEntry{Kind: journalEntryRemoteDesktop, WasActive: wasActive}); err != nil {
+		return err
 	}
 
-	log.Printf(" (!) Changing password of user: %s", user.Username)
+	for _, pth := range ardSettingsFiles {
+		if err := stepJournal.RecordRootFile(pth); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	cmd := command.New("sudo", "dscl", ".", "-passwd", "/Users/"+user.Username, changePasswordTo)
-	if isDebugMode {
-		log.Infof("\n$ %s\n", cmd.PrintableCommandArgs())
+func restoreRemoteDesktop(wasActive bool) error {
+	if wasActive {
+		return newSudoCommand(kickstart, "-restart", "-agent").Run()
 	}
-	return cmd.Run()
+	return newSudoCommand(kickstart, "-deactivate", "-configure", "-access", "-off").Run()
 }
 
-func createNgrokConf(authToken string, isSSH, isVNC bool) error {
-	tunnels := map[string]NgrokTunnelConfig{}
-	if isSSH {
-		tunnels["ssh"] = NgrokTunnelConfig{
-			Addr:  22,
-			Proto: "tcp",
-		}
+// ChangeUserPassword changes the password of the current user.
+// If the current password is known, the login keychain is updated and unlocked with the new password too,
+// and both can be restored at the end of the session.
+func ChangeUserPassword(currentPassword, changePasswordTo string) error {
+	user, err := user.Current()
+	if err != nil {
+		return errors.WithStack(err)
 	}
-	if isVNC {
-		tunnels["vnc"] = NgrokTunnelConfig{
-			Addr:  5900,
-			Proto: "tcp",
+
+	keychainPth := ""
+	if currentPassword != "" {
+		if err := newCommand("dscl", ".", "-authonly", user.Username, currentPassword).Run(); err != nil {
+			return errors.Errorf("The specified current password of user %s is incorrect", user.Username)
+		}
+
+		if keychainPth, err = loginKeychainPath(); err != nil {
+			return err
 		}
 	}
 
-	ngrokConfig := NgrokConfig{
-		Authtoken: authToken,
-		Tunnels:   tunnels,
+	log.Printf(" (!) Changing password of user: %s", user.Username)
+
+	if err := stepJournal.Record(JournalEntry{
+		Kind:        journalEntryUserPassword,
+		Username:    user.Username,
+		OldPassword: currentPassword,
+	}); err != nil {
+		return err
 	}
 
-	ngrokConfigBytes, err := json.Marshal(ngrokConfig)
-	if err != nil {
-		errors.WithStack(err)
+	if err := newSudoCommand("dscl", ".", "-passwd", "/Users/"+user.Username, changePasswordTo).Run(); err != nil {
+		return err
 	}
 
-	if isDebugMode {
-		log.Warnf("ngrok config: %s", ngrokConfigBytes)
+	if keychainPth == "" {
+		log.Warnf("The current password of the user is not specified, the login keychain is left locked with the previous password")
+		return nil
 	}
 
-	return errors.WithStack(fileutil.WriteBytesToFile(ngrokFile, ngrokConfigBytes))
-}
+	log.Printf("Updating the password of the login keychain: %s", keychainPth)
 
-func startNgrokAsync() error {
-	cmd := command.New("ngrok", "start", "--all", "--config", ngrokFile)
-	log.Infof("\n$ %s\n", cmd.PrintableCommandArgs())
-	return cmd.GetCmd().Start()
+	if err := setKeychainPassword(keychainPth, currentPassword, changePasswordTo); err != nil {
+		return err
+	}
+	// recorded only once changed, otherwise the rollback would fail with the new password
+	if err := stepJournal.Record(JournalEntry{
+		Kind:        journalEntryKeychainPassword,
+		Path:        keychainPth,
+		OldPassword: currentPassword,
+		NewPassword: changePasswordTo,
+	}); err != nil {
+		return err
+	}
+
+	return unlockKeychain(keychainPth, changePasswordTo)
 }
 
-func fetchAndPrintAcessInfosFromNgrok() error {
-	// fetch ngrok tunnel infos via its localhost api
-	client := &http.Client{Timeout: 10 * time.Second}
-	var resp *http.Response
-	err := retry.Times(3).Wait(5 * time.Second).Try(func(attempt uint) error {
-		if attempt != 0 {
-			if isDebugMode {
-				log.Warnf("Attempt %d failed, retrying ...", attempt)
-			}
-		}
-		var err error
-		resp, err = client.Get("http://localhost:4040/api/tunnels")
-		return errors.WithStack(err)
-	})
+func fetchAndPrintAcessInfosFromNgrok(ctx context.Context, configs ConfigsModel, sessionUser SessionUser) error {
+	// fetch ngrok tunnel infos via its localhost api, once every tunnel is up
+	tunnels, err := waitForTunnels(ctx, configs.tunnelDefinitions(), configs.TunnelDiscoveryTimeout)
 	if err != nil {
-		return errors.WithStack(err)
+		return err
 	}
-	defer resp.Body.Close()
-
-	ngrokTunnels := struct {
-		Tunnels []struct {
-			Name      string `json:"name"`
-			PublicURL string `json:"public_url"`
-		} `json:"tunnels"`
-	}{}
 
-	if err := json.NewDecoder(resp.Body).Decode(&ngrokTunnels); err != nil {
-		return errors.WithStack(err)
+	if err := verifyTunnelReservations(configs.tunnelDefinitions(), tunnels); err != nil {
+		return err
 	}
 
-	user, err := user.Current()
-	if err != nil {
-		return errors.WithStack(err)
-	}
-	currentUserUsername := user.Username
+	currentUserUsername := sessionUser.Username
+
+	sort.Slice(tunnels, func(i, j int) bool { return tunnels[i].Name < tunnels[j].Name })
 
 	fmt.Println()
 	fmt.Println("--- Remote Access configs ---")
 	fmt.Println("Remote Access is now configured and enabled. ")
 
-	for _, aTunnel := range ngrokTunnels.Tunnels {
+	for _, aTunnel := range tunnels {
 		switch aTunnel.Name {
-		case "ssh":
+		case sshTunnelName:
 			sshURL, err := url.Parse(aTunnel.PublicURL)
 			if err != nil {
 				return errors.WithStack(err)
@@ -176,8 +218,29 @@ func fetchAndPrintAcessInfosFromNgrok() error {
 			fmt.Println("SSH:")
 			fmt.Println("To SSH into this host:")
 			fmt.Println(" * First ensure that the SSH key you specified is activated (e.g. run: `ssh-add -D && ssh-add /path/to/ssh/private-key`")
+			if configs.shouldGenerateSSHKey() {
+				fmt.Printf("   (the private key of the one-time SSH key pair is exported as $%s", generatedSSHKeyOutputKey)
+				if configs.ArtifactRecipient != "" {
+					fmt.Printf(", and encrypted to the recipient in the %s.age artifact, decrypt it with: `age -d -i /path/to/identity -o ./remote-access-key %s.age`", generatedSSHKeyArtifactName, generatedSSHKeyArtifactName)
+				}
+				fmt.Println(")")
+			}
+			if configs.SSHCAPublicKey != "" {
+				printCertificateAuthorityInfo(configs.SSHCAPublicKey, configs.SSHCAPrincipals)
+			}
 			fmt.Printf(" * Then ssh with: `ssh %s@%s -p %s`\n", currentUserUsername, sshURL.Hostname(), sshURL.Port())
-		case "vnc":
+
+			if configs.isVNCEnabled() && configs.VNCTunnelMode == vncTunnelModeSSH {
+				fmt.Println()
+				fmt.Println("VNC (Screen Sharing) through SSH:")
+				fmt.Println("To VNC / Screen Share / Remote Desktop into this host, first forward the VNC port through SSH:")
+				fmt.Printf("    ssh -N -L 5900:localhost:%d %s@%s -p %s\n", configs.VNCPort, currentUserUsername, sshURL.Hostname(), sshURL.Port())
+				fmt.Println("then, while the above command is running, run the following command in another Terminal:")
+				fmt.Printf("    open vnc://%s@localhost:5900\n", currentUserUsername)
+				fmt.Printf("Privileges: %s\n", configs.ScreenSharePrivileges)
+				printVNCCredentialsInfo(configs, sessionUser)
+			}
+		case vncTunnelName:
 			vncURL, err := url.Parse(aTunnel.PublicURL)
 			if err != nil {
 				return errors.WithStack(err)
@@ -186,9 +249,12 @@ func fetchAndPrintAcessInfosFromNgrok() error {
 			fmt.Println("VNC (Screen Sharing):")
 			fmt.Println("To VNC / Screen Share / Remote Desktop into this host run the following command in your Terminal:")
 			fmt.Printf("    open vnc://%s@%s:%s\n", currentUserUsername, vncURL.Hostname(), vncURL.Port())
-			log.Warnf("Note: the password for the login is the password you specified for this step!")
+			fmt.Printf("Privileges: %s\n", configs.ScreenSharePrivileges)
+			printVNCCredentialsInfo(configs, sessionUser)
 		default:
-			return errors.Errorf("Unexpected tunnel found: %+v", aTunnel)
+			fmt.Println()
+			fmt.Printf("Tunnel %s (%s, local address: %s):\n", aTunnel.Name, aTunnel.Proto, aTunnel.Config.Addr)
+			fmt.Printf("    %s\n", aTunnel.PublicURL)
 		}
 	}
 
@@ -199,64 +265,303 @@ func fetchAndPrintAcessInfosFromNgrok() error {
 	return nil
 }
 
-func doMain() error {
-	configs := createConfigsModelFromEnvs()
+func printVNCCredentialsInfo(configs ConfigsModel, sessionUser SessionUser) {
+	if !configs.isVNCPasswordGenerated && !sessionUser.IsTemporary && configs.UserPassword == configs.VNCPassword {
+		log.Warnf("Note: the password for the login is the password you specified for this step!")
+		return
+	}
+
+	vncPassword := "the Screen Share password you specified for this step"
+	if configs.isVNCPasswordGenerated {
+		vncPassword = fmt.Sprintf("the generated password exported as $%s", vncPasswordOutputKey)
+	}
+
+	var login string
+	switch {
+	case sessionUser.IsTemporary:
+		login = fmt.Sprintf("as %s, with the password exported as $%s", sessionUser.Username, sessionUserPasswordOutputKey)
+	case configs.UserPassword == "":
+		login = "with the existing password of the user, which was not changed by this step"
+	case configs.UserPassword == configs.VNCPassword:
+		login = "with the same password"
+	default:
+		login = "with the User password you specified for this step"
+	}
+
+	log.Warnf("Note: when the VNC client asks for a password, use %s,", vncPassword)
+	log.Warnf("then log in to macOS %s.", login)
+}
+
+func printCertificateAuthorityInfo(caKey string, principals []string) {
+	key, err := parseCertificateAuthorityKey(caKey)
+	if err != nil {
+		return
+	}
+
+	fmt.Printf("   (or a certificate issued by the SSH CA: %s", key.Fingerprint())
+	if len(principals) > 0 {
+		fmt.Printf(", for any of the principals: %s", strings.Join(principals, ", "))
+	}
+	fmt.Println(")")
+}
+
+func rollback(journal *Journal) error {
+	if journal.IsEmpty() {
+		log.Printf("No system changes to roll back")
+		return nil
+	}
+
+	fmt.Println()
+	log.Printf("Rolling back %d system change(s) ...", len(journal.Entries))
+	if err := journal.Rollback(); err != nil {
+		return err
+	}
+	log.Donef("System changes rolled back")
+	return nil
+}
+
+func doMain() (err error) {
+	configs, err := createConfigsModelFromEnvs()
+	if err != nil {
+		return errors.Wrap(err, "Issue with input")
+	}
 	configs.print()
 	if err := configs.validate(); err != nil {
 		return errors.Wrap(err, "Issue with input")
 	}
 	isDebugMode = configs.IsStepDebugMode
 
+	journal, err := openJournal(configs.JournalPath)
+	if err != nil {
+		return errors.Wrap(err, "Failed to open journal")
+	}
+
+	if configs.RunMode == runModeRollback {
+		return rollback(journal)
+	}
+
+	if !journal.IsEmpty() {
+		log.Warnf("Found %d system change(s) left behind by a previous run, those will be rolled back at the end of this session too", len(journal.Entries))
+	}
+
+	// trap the signals until the rollback finishes
+	ctx, stop := signalContext()
+	defer stop()
+
+	// once the step is aborted, its exit code only depends on the teardown (stopping ngrok and the rollback)
+	var teardownErr error
+	teardownFailed := func(e error) {
+		if teardownErr == nil {
+			teardownErr = e
+		} else {
+			log.Errorf("%s", e)
+		}
+	}
+	defer func() {
+		if err != nil && ctx.Err() != nil {
+			log.Warnf("Aborted: %s", err)
+			err = nil
+		}
+		if teardownErr == nil {
+			return
+		}
+		if err == nil {
+			err = teardownErr
+		} else {
+			log.Errorf("%s", teardownErr)
+		}
+	}()
+
+	stepJournal = journal
+	defer func() {
+		if rollbackErr := rollback(journal); rollbackErr != nil {
+			teardownFailed(errors.Wrap(rollbackErr, "Failed to roll back system changes"))
+		}
+	}()
+
+	if configs.GenerateVNCPassword && configs.VNCPassword == "" {
+		fmt.Println()
+		log.Printf("Generate one-time Screen Share password ...")
+		if err := configs.generateVNCPassword(); err != nil {
+			return err
+		}
+	} else if len(configs.VNCPassword) > vncPasswordMaxLength {
+		log.Warnf("Legacy VNC authentication only uses the first %d characters of the Screen Share password", vncPasswordMaxLength)
+	}
+
+	sessionUser, err := currentSessionUser()
+	if err != nil {
+		return err
+	}
+	if configs.CreateSessionUser {
+		fmt.Println()
+		log.Printf("Temporary user setup ...")
+		password := configs.UserPassword
+		if password == "" {
+			if password, err = generatePassword(sessionUserPasswordLength, passwordAlphabet); err != nil {
+				return errors.Wrap(err, "Failed to generate password")
+			}
+		}
+
+		if sessionUser, err = CreateTemporaryUser(configs.SessionUsername, password, configs.SessionUserIsAdmin, configs.SessionUserIsSudoer); err != nil {
+			return errors.Wrap(err, "Can't create temporary user")
+		}
+		if err := exportSessionUserPassword(password, configs.ArtifactRecipient); err != nil {
+			return err
+		}
+	}
+
+	if err := checkInterrupted(ctx); err != nil {
+		return err
+	}
+
 	fmt.Println()
 	log.Printf("SSH setup ...")
+	keyRestrictions := configs.authorizedKeyRestrictions()
+	authorizedKeysPth := sessionUser.AuthorizedKeysPath()
 	if configs.SSHPublicKey != "" {
 		log.Printf("Add authorized key ...")
-		if err := AddAuthorizedKey(configs.SSHPublicKey); err != nil {
+		if err := AddAuthorizedKey(authorizedKeysPth, configs.SSHPublicKey, keyRestrictions); err != nil {
 			return errors.Wrap(err, "Can't add authorized key")
 		}
-	} else {
+	}
+	if configs.shouldGenerateSSHKey() {
+		log.Printf("Generate one-time SSH key pair ...")
+		if err := AddGeneratedAuthorizedKey(authorizedKeysPth, keyRestrictions, configs.ArtifactRecipient); err != nil {
+			return errors.Wrap(err, "Can't add generated SSH key")
+		}
+	}
+	if len(configs.GitHubUsers) > 0 {
+		log.Printf("Add authorized keys of GitHub users ...")
+		if err := AddGitHubUsersAuthorizedKeys(ctx, authorizedKeysPth, configs.GitHubURL, configs.GitHubUsers, keyRestrictions); err != nil {
+			return errors.Wrap(err, "Can't add authorized keys of GitHub users")
+		}
+	}
+	if configs.SSHCAPublicKey != "" {
+		log.Printf("Add SSH certificate authority ...")
+		if err := AddCertificateAuthority(authorizedKeysPth, configs.SSHCAPublicKey, configs.SSHCAPrincipals, keyRestrictions); err != nil {
+			return errors.Wrap(err, "Can't add SSH certificate authority")
+		}
+	}
+	if !configs.isSSHEnabled() {
 		log.Warnf("No SSH public key specified, skipping SSH setup.")
 	}
+	if err := sessionUser.InstallAuthorizedKeys(); err != nil {
+		return errors.Wrap(err, "Can't install authorized keys of the temporary user")
+	}
+
+	if err := checkInterrupted(ctx); err != nil {
+		return err
+	}
 
 	fmt.Println()
 	log.Printf("VNC / remote desktop / screen sharing setup ...")
-	if configs.PasswordToSet != "" {
+	if configs.UserPassword != "" && !sessionUser.IsTemporary {
 		log.Printf("Change user password...")
-		if err := ChangeUserPassword(configs.PasswordToSet); err != nil {
+		if err := ChangeUserPassword(configs.CurrentUserPassword, configs.UserPassword); err != nil {
 			return errors.Wrap(err, "Can't change user password")
 		}
-
+	}
+	if configs.isVNCEnabled() {
 		log.Printf("Enable remote desktop...")
-		if err := EnableRemoteDesktop(configs.PasswordToSet); err != nil {
+		if err := EnableRemoteDesktop(configs.VNCPassword, configs.ScreenSharePrivileges); err != nil {
 			return errors.Wrap(err, "Can't enable remote desktop")
 		}
 	} else {
-		log.Warnf("No (User & VNC) Password specified, skipping Remote Desktop / Screen Sharing setup.")
+		log.Warnf("No VNC Password specified, skipping Remote Desktop / Screen Sharing setup.")
+	}
+
+	if err := checkInterrupted(ctx); err != nil {
+		return err
 	}
 
 	fmt.Println()
+	log.Printf("ngrok agent setup ...")
+	if err := ensureNgrok(ctx, configs.ngrokInstallOptions()); err != nil {
+		return errors.Wrap(err, "Failed to install ngrok")
+	}
+	ngrokVersion, err := detectNgrokAgentVersion()
+	if err != nil {
+		return errors.Wrap(err, "Failed to detect the ngrok agent version")
+	}
+	log.Printf("ngrok agent version: %s", ngrokVersion)
+
 	log.Printf("Creating Ngrok config to %s", ngrokFile)
-	if err := createNgrokConf(configs.NgrokAuthToken, configs.SSHPublicKey != "", configs.PasswordToSet != ""); err != nil {
+	if err := createNgrokConf(ngrokVersion, configs.ngrokAgentOptions(), configs.tunnelDefinitions()); err != nil {
 		return errors.Wrap(err, "Failed to create Ngrok config")
 	}
 
+	setNgrokWebAddr(configs.NgrokWebAddr)
+	controller := newTunnelController(ngrokVersion, configs.tunnelDefinitions())
+
+	if err := checkInterrupted(ctx); err != nil {
+		return err
+	}
+
 	log.Printf("Starting Ngrok...")
-	if err := startNgrokAsync(); err != nil {
+	ngrok, err := startNgrokSupervisor(ctx, configs.NgrokMaxRestarts, func(ctx context.Context) error {
+		// wait until the restarted agent is up with the tunnels of the config, before reopening the others
+		if err := fetchAndPrintAcessInfosFromNgrok(ctx, configs, sessionUser); err != nil {
+			return err
+		}
+		controller.Reopen()
+		return nil
+	})
+	if err != nil {
 		return errors.Wrap(err, "Failed to start Ngrok")
 	}
+	defer func() {
+		fmt.Println()
+		log.Printf("Stopping Ngrok...")
+		if stopErr := ngrok.Stop(ngrokStopTimeout); stopErr != nil {
+			teardownFailed(errors.Wrap(stopErr, "Failed to stop Ngrok"))
+		}
+	}()
+
+	if configs.CaptureHTTPRequests {
+		log.Printf("Capturing HTTP requests ...")
+		recorder := startHTTPRequestRecorder(configs.HARRedactHeaders)
+		defer func() {
+			recorder.Stop()
+			pth, count, harErr := recorder.WriteHAR()
+			if harErr != nil {
+				log.Errorf("Failed to write the captured HTTP requests: %s", harErr)
+				return
+			}
+			log.Printf("%d captured HTTP request(s) written to: %s", count, pth)
+		}()
+	}
 
 	log.Printf("Checking access configurations ...")
-	if err := fetchAndPrintAcessInfosFromNgrok(); err != nil {
+	if err := fetchAndPrintAcessInfosFromNgrok(ctx, configs, sessionUser); err != nil {
 		return errors.Wrap(err, "Failed to fetch access infos from ngrok")
 	}
 
-	// wait forever
+	if configs.TunnelControl {
+		if err := controller.Start(sessionUser); err != nil {
+			return errors.Wrap(err, "Failed to start the tunnel control")
+		}
+		defer func() {
+			if stopErr := controller.Stop(); stopErr != nil {
+				log.Warnf("Failed to stop the tunnel control: %s", stopErr)
+			}
+		}()
+
+		fmt.Println()
+		fmt.Println("To open or close tunnels during the session, run in the remote session:")
+		fmt.Printf("    %s open name=inspector, addr=9222\n", controlCommandFile)
+		fmt.Printf("    %s close inspector\n", controlCommandFile)
+		fmt.Printf("    %s list\n", controlCommandFile)
+	}
+
 	fmt.Println()
 	fmt.Println("You can now connect, keeping the connection open ...")
-	for {
-		fmt.Print(".")
-		time.Sleep(10 * time.Second)
+	reason, err := waitForSessionEnd(ctx, ngrok.Failed(), configs.SessionTimeout, configs.IdleTimeout)
+	if err != nil {
+		return errors.Wrap(err, "Session failed")
 	}
+	fmt.Println()
+	log.Warnf("Session ended: %s", reason)
 
 	return nil
 }
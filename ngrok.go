@@ -0,0 +1,377 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/bitrise-io/go-utils/command"
+	"github.com/bitrise-io/go-utils/log"
+	"github.com/bitrise-io/go-utils/sliceutil"
+	"github.com/bitrise-steplib/steps-remote-access-macos-ngrok/internal/ngrokapi"
+	"github.com/pkg/errors"
+)
+
+const (
+	ngrokDefaultWebAddr = "localhost:4040"
+	ngrokStopTimeout    = 10 * time.Second
+
+	ngrokMaxRestartBackoff = 30 * time.Second
+	// the restarts are counted again once the agent was running for this long
+	ngrokStableRunDuration = 5 * time.Minute
+
+	defaultTunnelDiscoveryTimeout = time.Minute
+	tunnelDiscoveryMinBackoff     = 500 * time.Millisecond
+	tunnelDiscoveryMaxBackoff     = 5 * time.Second
+)
+
+// ngrok regions
+var ngrokRegions = []string{"us", "eu", "ap", "au", "sa", "jp", "in"}
+
+// ngrok log levels and formats
+var (
+	ngrokLogLevels  = []string{"debug", "info", "warn", "error", "crit"}
+	ngrokLogFormats = []string{"term", "logfmt", "json"}
+)
+
+// ngrokAPI is the client of the local agent API, served on the web_addr of the agent.
+var ngrokAPI = ngrokapi.New("http://"+ngrokDefaultWebAddr, ngrokapi.DefaultTimeout)
+
+// setNgrokWebAddr points the agent API calls to the given web_addr.
+func setNgrokWebAddr(webAddr string) {
+	if webAddr == "" {
+		webAddr = ngrokDefaultWebAddr
+	}
+	ngrokAPI = ngrokapi.New("http://"+webAddr, ngrokapi.DefaultTimeout)
+}
+
+// waitForTunnels polls the agent API, with exponential backoff, until every defined tunnel is running
+// with a public URL, and returns the running tunnels. It fails, naming the missing tunnels, once the timeout is reached,
+// or right away if the given context is cancelled.
+func waitForTunnels(parentCtx context.Context, definitions []TunnelDefinition, timeout time.Duration) ([]ngrokapi.Tunnel, error) {
+	ctx, cancel := context.WithTimeout(parentCtx, timeout)
+	defer cancel()
+
+	backoff := tunnelDiscoveryMinBackoff
+	for attempt := 1; ; attempt++ {
+		tunnels, err := ngrokAPI.ListTunnels(ctx)
+		missing := missingTunnels(definitions, tunnels)
+		if err == nil && len(missing) == 0 {
+			return tunnels, nil
+		}
+		if isDebugMode {
+			if err != nil {
+				log.Warnf("Attempt %d: failed to list the tunnels: %s", attempt, err)
+			} else {
+				log.Warnf("Attempt %d: tunnels not up yet: %s", attempt, strings.Join(missing, ", "))
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			if parentCtx.Err() != nil {
+				return nil, errors.Wrap(parentCtx.Err(), "tunnel discovery interrupted")
+			}
+			msg := fmt.Sprintf("tunnels not up after %s: %s", timeout, strings.Join(missing, ", "))
+			if err != nil {
+				return nil, errors.Wrap(err, msg)
+			}
+			return nil, errors.New(msg)
+		case <-time.After(backoff):
+		}
+
+		if backoff *= 2; backoff > tunnelDiscoveryMaxBackoff {
+			backoff = tunnelDiscoveryMaxBackoff
+		}
+	}
+}
+
+// NgrokAgentOptions are the session level options of the ngrok agent.
+type NgrokAgentOptions struct {
+	Authtoken   string
+	Region      string
+	Metadata    string
+	HTTPProxy   string
+	SOCKS5Proxy string
+	WebAddr     string
+	LogLevel    string
+	LogFormat   string
+}
+
+func (options NgrokAgentOptions) validate() error {
+	if options.Authtoken == "" {
+		return errors.New("no authtoken specified")
+	}
+	if options.Region != "" && !sliceutil.IsStringInSlice(options.Region, ngrokRegions) {
+		return errors.Errorf("invalid region (%s), should be one of: %s", options.Region, strings.Join(ngrokRegions, ", "))
+	}
+	if options.HTTPProxy != "" && options.SOCKS5Proxy != "" {
+		return errors.New("either an HTTP or a SOCKS5 proxy can be specified, not both")
+	}
+	if options.HTTPProxy != "" {
+		if u, err := url.Parse(options.HTTPProxy); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.Errorf("invalid http_proxy (%s), should be an http(s):// URL", redactURL(options.HTTPProxy))
+		}
+	}
+	if options.SOCKS5Proxy != "" {
+		if u, err := url.Parse(options.SOCKS5Proxy); err != nil || u.Scheme != "socks5" || u.Host == "" {
+			return errors.Errorf("invalid socks5_proxy (%s), should be a socks5:// URL", redactURL(options.SOCKS5Proxy))
+		}
+	}
+	if options.WebAddr != "" {
+		if _, port, err := net.SplitHostPort(options.WebAddr); err != nil || validatePort(port) != nil {
+			return errors.Errorf("invalid web_addr (%s), should be host:port, e.g. %s", options.WebAddr, ngrokDefaultWebAddr)
+		}
+	}
+	if options.LogLevel != "" && !sliceutil.IsStringInSlice(options.LogLevel, ngrokLogLevels) {
+		return errors.Errorf("invalid log_level (%s), should be one of: %s", options.LogLevel, strings.Join(ngrokLogLevels, ", "))
+	}
+	if options.LogFormat != "" && !sliceutil.IsStringInSlice(options.LogFormat, ngrokLogFormats) {
+		return errors.Errorf("invalid log_format (%s), should be one of: %s", options.LogFormat, strings.Join(ngrokLogFormats, ", "))
+	}
+	return nil
+}
+
+// redactURL hides the password of the URL, as proxy URLs might contain credentials.
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.User == nil {
+		return rawURL
+	}
+	if _, hasPassword := u.User.Password(); hasPassword {
+		u.User = url.UserPassword(u.User.Username(), "***")
+	}
+	return u.String()
+}
+
+func startNgrokAsync() (*exec.Cmd, error) {
+	// the agent only writes to the output if logging is configured, or on a startup error
+	cmd := command.New("ngrok", "start", "--all", "--config", ngrokFile).SetStdout(os.Stdout).SetStderr(os.Stderr)
+	log.Infof("\n$ %s\n", cmd.PrintableCommandArgs())
+
+	// run ngrok in its own process group, so it can be stopped together with its children
+	cmd.GetCmd().SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.GetCmd().Start(); err != nil {
+		return nil, err
+	}
+	return cmd.GetCmd(), nil
+}
+
+// ngrokSupervisor runs the ngrok agent and restarts it with backoff if it exits unexpectedly.
+type ngrokSupervisor struct {
+	maxRestarts int
+	// onRestart is called after every successful restart, with a context cancelled once the supervisor is stopped
+	onRestart func(ctx context.Context) error
+	ctx       context.Context
+	cancel    func()
+
+	mu       sync.Mutex
+	cmd      *exec.Cmd
+	stopping bool
+	// running is true while the agent process is running
+	running bool
+
+	stop   chan struct{}
+	done   chan struct{}
+	failed chan error
+}
+
+// startNgrokSupervisor starts the ngrok agent and supervises it in the background.
+// The context passed to onRestart is cancelled once the given context is cancelled, or the supervisor is stopped.
+func startNgrokSupervisor(ctx context.Context, maxRestarts int, onRestart func(ctx context.Context) error) (*ngrokSupervisor, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	supervisor := &ngrokSupervisor{
+		maxRestarts: maxRestarts,
+		onRestart:   onRestart,
+		ctx:         ctx,
+		cancel:      cancel,
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+		failed:      make(chan error, 1),
+	}
+
+	exited, err := supervisor.start()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	go supervisor.run(exited)
+
+	return supervisor, nil
+}
+
+// Failed receives an error once the agent exited and could not be restarted.
+func (supervisor *ngrokSupervisor) Failed() <-chan error {
+	return supervisor.failed
+}
+
+// start starts a new agent process, the returned channel receives its exit status.
+func (supervisor *ngrokSupervisor) start() (<-chan error, error) {
+	supervisor.mu.Lock()
+	defer supervisor.mu.Unlock()
+
+	if supervisor.stopping {
+		return nil, errors.New("ngrok supervisor is stopping")
+	}
+
+	cmd, err := startNgrokAsync()
+	if err != nil {
+		return nil, err
+	}
+	supervisor.cmd = cmd
+	supervisor.running = true
+
+	exited := make(chan error, 1)
+	go func() {
+		err := cmd.Wait()
+		supervisor.mu.Lock()
+		supervisor.running = false
+		supervisor.mu.Unlock()
+		exited <- err
+	}()
+	return exited, nil
+}
+
+func (supervisor *ngrokSupervisor) isStopping() bool {
+	supervisor.mu.Lock()
+	defer supervisor.mu.Unlock()
+	return supervisor.stopping
+}
+
+func (supervisor *ngrokSupervisor) run(exited <-chan error) {
+	defer close(supervisor.done)
+
+	restarts := 0
+	startTime := time.Now()
+	for {
+		var exitErr error
+		select {
+		case <-supervisor.stop:
+			<-exited
+			return
+		case exitErr = <-exited:
+		}
+
+		if supervisor.isStopping() {
+			return
+		}
+
+		if time.Since(startTime) >= ngrokStableRunDuration {
+			restarts = 0
+		}
+
+		fmt.Println()
+		if restarts >= supervisor.maxRestarts {
+			supervisor.failed <- errors.Errorf("ngrok exited (%v) and the maximum number of restarts (%d) is reached", exitErr, supervisor.maxRestarts)
+			return
+		}
+		restarts++
+
+		backoff := ngrokRestartBackoff(restarts)
+		log.Warnf("ngrok exited unexpectedly (%v), restarting in %s (%d/%d) ...", exitErr, backoff, restarts, supervisor.maxRestarts)
+		select {
+		case <-supervisor.stop:
+			return
+		case <-time.After(backoff):
+		}
+
+		var err error
+		startTime = time.Now()
+		exited, err = supervisor.start()
+		if err != nil {
+			if supervisor.isStopping() {
+				return
+			}
+			log.Errorf("Failed to restart ngrok: %s", err)
+			failedStart := make(chan error, 1)
+			failedStart <- err
+			exited = failedStart
+			continue
+		}
+
+		if err := supervisor.onRestart(supervisor.ctx); err != nil {
+			log.Errorf("ngrok restarted, but: %s", err)
+		}
+	}
+}
+
+func ngrokRestartBackoff(restart int) time.Duration {
+	backoff := time.Second
+	for i := 1; i < restart && backoff < ngrokMaxRestartBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > ngrokMaxRestartBackoff {
+		backoff = ngrokMaxRestartBackoff
+	}
+	return backoff
+}
+
+// Stop closes the tunnels through the agent API, then terminates the ngrok process group
+// and waits for it to exit. The process group is killed if it does not exit within the timeout.
+// If the agent is not running (e.g. it is waiting to be restarted) only the supervision is stopped.
+func (supervisor *ngrokSupervisor) Stop(timeout time.Duration) error {
+	supervisor.mu.Lock()
+	supervisor.stopping = true
+	cmd := supervisor.cmd
+	running := supervisor.running
+	supervisor.mu.Unlock()
+	close(supervisor.stop)
+	supervisor.cancel()
+
+	if !running {
+		<-supervisor.done
+		return nil
+	}
+
+	var teardownErr error
+	if err := deleteNgrokTunnels(context.Background()); err != nil {
+		log.Warnf("Failed to close tunnels: %s", err)
+		teardownErr = errors.Wrap(err, "Failed to close tunnels")
+	}
+
+	pgid := -cmd.Process.Pid
+	if err := syscall.Kill(pgid, syscall.SIGTERM); err != nil && err != syscall.ESRCH {
+		return errors.Wrap(err, "Failed to terminate ngrok")
+	}
+
+	select {
+	case <-supervisor.done:
+		// the exit status is irrelevant, the process was terminated on purpose
+		return teardownErr
+	case <-time.After(timeout):
+	}
+
+	log.Warnf("ngrok did not exit within %s, killing it", timeout)
+	if err := syscall.Kill(pgid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+		return errors.Wrap(err, "Failed to kill ngrok")
+	}
+	<-supervisor.done
+
+	return errors.Errorf("ngrok did not exit within %s and had to be killed", timeout)
+}
+
+func deleteNgrokTunnels(ctx context.Context) error {
+	tunnels, err := ngrokAPI.ListTunnels(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, tunnel := range tunnels {
+		if isDebugMode {
+			log.Printf("Closing tunnel: %s", tunnel.Name)
+		}
+		// the additional http tunnel is closed together with its https pair
+		if err := ngrokAPI.StopTunnel(ctx, tunnel.Name); err != nil && !ngrokapi.IsNotFound(err) {
+			return errors.Wrapf(err, "Failed to close tunnel (%s)", tunnel.Name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/fileutil"
+	"github.com/bitrise-io/go-utils/log"
+	"github.com/bitrise-io/go-utils/versions"
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	// older v2 agents are rejected by the ngrok service
+	ngrokMinAgentVersion = "2.3.40"
+	// the first agent version supporting the version 3 config, with the agent section
+	ngrokConfigV3MinAgentVersion = "3.16.0"
+)
+
+// agent config versions of the v3 agent
+const (
+	ngrokConfigVersion2 = "2"
+	ngrokConfigVersion3 = "3"
+)
+
+var ngrokVersionRegexp = regexp.MustCompile(`\d+\.\d+\.\d+`)
+
+// NgrokAgentVersion is the version of the installed ngrok agent, e.g. 3.5.0.
+type NgrokAgentVersion string
+
+// detectNgrokAgentVersion returns the version of the ngrok agent on the PATH.
+func detectNgrokAgentVersion() (NgrokAgentVersion, error) {
+	out, err := newCommand("ngrok", "version").RunAndReturnTrimmedCombinedOutput()
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to get the ngrok version: %s", out)
+	}
+	return parseNgrokAgentVersion(out)
+}
+
+// parseNgrokAgentVersion parses the output of the ngrok version command, e.g. "ngrok version 3.5.0".
+func parseNgrokAgentVersion(out string) (NgrokAgentVersion, error) {
+	version := ngrokVersionRegexp.FindString(out)
+	if version == "" {
+		return "", errors.Errorf("Unexpected ngrok version output: %s", out)
+	}
+	return NgrokAgentVersion(version), nil
+}
+
+// Major returns the major version of the agent.
+func (version NgrokAgentVersion) Major() string {
+	return strings.SplitN(string(version), ".", 2)[0]
+}
+
+// isAtLeast returns true if the agent version is greater than or equal to the given one.
+func (version NgrokAgentVersion) isAtLeast(minVersion string) bool {
+	isAtLeast, err := versions.IsVersionGreaterOrEqual(string(version), minVersion)
+	return err == nil && isAtLeast
+}
+
+// validate returns an error if the config format or the CLI of the agent is not supported by the step.
+func (version NgrokAgentVersion) validate() error {
+	switch version.Major() {
+	case "2":
+		if !version.isAtLeast(ngrokMinAgentVersion) {
+			return errors.Errorf("ngrok agent version %s is not supported, it is rejected by the ngrok service, use version %s or newer", version, ngrokMinAgentVersion)
+		}
+	case "3":
+	default:
+		return errors.Errorf("ngrok agent version %s is not supported, use a %s or newer 2.x, or a 3.x version", version, ngrokMinAgentVersion)
+	}
+	return nil
+}
+
+// configVersion returns the config version to generate for the agent, empty for the v2 agent.
+func (version NgrokAgentVersion) configVersion() string {
+	switch {
+	case version.Major() == "2":
+		return ""
+	case version.isAtLeast(ngrokConfigV3MinAgentVersion):
+		return ngrokConfigVersion3
+	default:
+		return ngrokConfigVersion2
+	}
+}
+
+// NgrokTunnelConfig is a tunnel in the config of the v2 agent.
+type NgrokTunnelConfig struct {
+	Addr       string `yaml:"addr,omitempty"`
+	Proto      string `yaml:"proto,omitempty"`
+	Subdomain  string `yaml:"subdomain,omitempty"`
+	Hostname   string `yaml:"hostname,omitempty"`
+	RemoteAddr string `yaml:"remote_addr,omitempty"`
+
+	// http tunnel options
+	Auth       string      `yaml:"auth,omitempty"`
+	HostHeader string      `yaml:"host_header,omitempty"`
+	BindTLS    interface{} `yaml:"bind_tls,omitempty"`
+	Inspect    *bool       `yaml:"inspect,omitempty"`
+}
+
+// NgrokConfig is the config of the v2 agent.
+type NgrokConfig struct {
+	Authtoken   string                       `yaml:"authtoken,omitempty"`
+	Region      string                       `yaml:"region,omitempty"`
+	Metadata    string                       `yaml:"metadata,omitempty"`
+	HTTPProxy   string                       `yaml:"http_proxy,omitempty"`
+	SOCKS5Proxy string                       `yaml:"socks5_proxy,omitempty"`
+	WebAddr     string                       `yaml:"web_addr,omitempty"`
+	Log         string                       `yaml:"log,omitempty"`
+	LogLevel    string                       `yaml:"log_level,omitempty"`
+	LogFormat   string                       `yaml:"log_format,omitempty"`
+	Tunnels     map[string]NgrokTunnelConfig `yaml:"tunnels,omitempty"`
+}
+
+// NgrokV3TunnelConfig is a tunnel in the config of the v3 agent.
+type NgrokV3TunnelConfig struct {
+	Addr       string `yaml:"addr,omitempty"`
+	Proto      string `yaml:"proto,omitempty"`
+	Subdomain  string `yaml:"subdomain,omitempty"`
+	Domain     string `yaml:"domain,omitempty"`
+	RemoteAddr string `yaml:"remote_addr,omitempty"`
+
+	// http tunnel options
+	BasicAuth  []string `yaml:"basic_auth,omitempty"`
+	HostHeader string   `yaml:"host_header,omitempty"`
+	Schemes    []string `yaml:"schemes,omitempty"`
+	Inspect    *bool    `yaml:"inspect,omitempty"`
+
+	IPRestriction *NgrokIPRestriction `yaml:"ip_restriction,omitempty"`
+}
+
+// NgrokIPRestriction is the IP restriction of a tunnel in the config of the v3 agent.
+type NgrokIPRestriction struct {
+	AllowCIDRs []string `yaml:"allow_cidrs,omitempty"`
+	DenyCIDRs  []string `yaml:"deny_cidrs,omitempty"`
+}
+
+// NgrokV3AgentConfig are the agent options in the config of the v3 agent:
+// on the top level in a version 2 config, in the agent section in a version 3 config.
+type NgrokV3AgentConfig struct {
+	Authtoken string `yaml:"authtoken,omitempty"`
+	Region    string `yaml:"region,omitempty"`
+	Metadata  string `yaml:"metadata,omitempty"`
+	ProxyURL  string `yaml:"proxy_url,omitempty"`
+	WebAddr   string `yaml:"web_addr,omitempty"`
+	Log       string `yaml:"log,omitempty"`
+	LogLevel  string `yaml:"log_level,omitempty"`
+	LogFormat string `yaml:"log_format,omitempty"`
+}
+
+// NgrokV3Config is the config of the v3 agent.
+type NgrokV3Config struct {
+	Version            string `yaml:"version"`
+	NgrokV3AgentConfig `yaml:",inline"`
+	Agent              *NgrokV3AgentConfig            `yaml:"agent,omitempty"`
+	Tunnels            map[string]NgrokV3TunnelConfig `yaml:"tunnels,omitempty"`
+}
+
+// createNgrokConf validates the agent options and the tunnel definitions,
+// and writes the ngrok config of them, in the format of the given agent version.
+func createNgrokConf(version NgrokAgentVersion, options NgrokAgentOptions, definitions []TunnelDefinition) error {
+	if err := version.validate(); err != nil {
+		return err
+	}
+	if err := options.validate(); err != nil {
+		return errors.Wrap(err, "invalid agent options")
+	}
+	if len(definitions) == 0 {
+		return errors.New("no tunnel specified")
+	}
+	if err := validateTunnelDefinitions(definitions); err != nil {
+		return errors.Wrap(err, "invalid tunnel")
+	}
+
+	var ngrokConfig interface{}
+	if configVersion := version.configVersion(); configVersion == "" {
+		for _, definition := range definitions {
+			if definition.hasIPRestriction() {
+				return errors.Errorf("tunnel %s: IP restrictions are only supported by the v3 agent", definition.Name)
+			}
+		}
+		ngrokConfig = ngrokV2Config(options, definitions)
+	} else {
+		ngrokConfig = ngrokV3Config(configVersion, options, definitions)
+	}
+
+	ngrokConfigBytes, err := yaml.Marshal(ngrokConfig)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if isDebugMode {
+		log.Warnf("ngrok config:\n%s", ngrokConfigBytes)
+	}
+
+	if err := fileutil.WriteBytesToFileWithPermission(ngrokFile, ngrokConfigBytes, 0600); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if version.Major() == "3" {
+		// only the v3 agent is able to check its config
+		if out, err := newCommand("ngrok", "config", "check", "--config", ngrokFile).RunAndReturnTrimmedCombinedOutput(); err != nil {
+			return errors.Errorf("invalid ngrok config: %s", out)
+		}
+	}
+	return nil
+}
+
+func ngrokV2Config(options NgrokAgentOptions, definitions []TunnelDefinition) NgrokConfig {
+	tunnels := map[string]NgrokTunnelConfig{}
+	for _, definition := range definitions {
+		tunnels[definition.Name] = definition.ngrokConfig()
+	}
+
+	ngrokConfig := NgrokConfig{
+		Authtoken:   options.Authtoken,
+		Region:      options.Region,
+		Metadata:    options.Metadata,
+		HTTPProxy:   options.HTTPProxy,
+		SOCKS5Proxy: options.SOCKS5Proxy,
+		WebAddr:     options.WebAddr,
+		LogLevel:    options.LogLevel,
+		LogFormat:   options.LogFormat,
+		Tunnels:     tunnels,
+	}
+	if options.LogLevel != "" || options.LogFormat != "" {
+		// the agent does not log at all without a log target
+		ngrokConfig.Log = "stdout"
+	}
+	return ngrokConfig
+}
+
+func ngrokV3Config(configVersion string, options NgrokAgentOptions, definitions []TunnelDefinition) NgrokV3Config {
+	tunnels := map[string]NgrokV3TunnelConfig{}
+	for _, definition := range definitions {
+		tunnels[definition.Name] = definition.ngrokV3Config()
+	}
+
+	agentConfig := NgrokV3AgentConfig{
+		Authtoken: options.Authtoken,
+		Region:    options.Region,
+		Metadata:  options.Metadata,
+		ProxyURL:  options.HTTPProxy,
+		WebAddr:   options.WebAddr,
+		LogLevel:  options.LogLevel,
+		LogFormat: options.LogFormat,
+	}
+	if options.SOCKS5Proxy != "" {
+		agentConfig.ProxyURL = options.SOCKS5Proxy
+	}
+	if options.LogLevel != "" || options.LogFormat != "" {
+		// the agent does not log at all without a log target
+		agentConfig.Log = "stdout"
+	}
+
+	ngrokConfig := NgrokV3Config{
+		Version: configVersion,
+		Tunnels: tunnels,
+	}
+	if configVersion == ngrokConfigVersion3 {
+		if agentConfig.Region != "" {
+			log.Warnf("The region (%s) is ignored, the agent connects to the closest region", agentConfig.Region)
+			agentConfig.Region = ""
+		}
+		ngrokConfig.Agent = &agentConfig
+	} else {
+		ngrokConfig.NgrokV3AgentConfig = agentConfig
+	}
+	return ngrokConfig
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"testing"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestParseNgrokAgentVersion(t *testing.T) {
+	tests := []struct {
+		out     string
+		want    NgrokAgentVersion
+		wantErr bool
+	}{
+		{out: "ngrok version 3.5.0", want: "3.5.0"},
+		{out: "ngrok version 2.3.41", want: "2.3.41"},
+		{out: "ngrok version 3.16.1\nUpdate available", want: "3.16.1"},
+		{out: "ngrok version", wantErr: true},
+		{out: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseNgrokAgentVersion(tt.out)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseNgrokAgentVersion(%q) error: %v, wantErr: %t", tt.out, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseNgrokAgentVersion(%q) = %s, want: %s", tt.out, got, tt.want)
+		}
+	}
+}
+
+func TestNgrokAgentVersion(t *testing.T) {
+	tests := []struct {
+		version           NgrokAgentVersion
+		wantErr           bool
+		wantConfigVersion string
+	}{
+		{version: "2.3.39", wantErr: true},
+		{version: "2.3.40", wantConfigVersion: ""},
+		{version: "3.0.0", wantConfigVersion: ngrokConfigVersion2},
+		{version: "3.15.9", wantConfigVersion: ngrokConfigVersion2},
+		{version: "3.16.0", wantConfigVersion: ngrokConfigVersion3},
+		{version: "3.20.1", wantConfigVersion: ngrokConfigVersion3},
+		{version: "1.7.0", wantErr: true},
+		{version: "4.0.0", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		if err := tt.version.validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: validate() error: %v, wantErr: %t", tt.version, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if got := tt.version.configVersion(); got != tt.wantConfigVersion {
+			t.Errorf("%s: configVersion() = %q, want: %q", tt.version, got, tt.wantConfigVersion)
+		}
+	}
+}
+
+func TestNgrokConfig(t *testing.T) {
+	options := NgrokAgentOptions{
+		Authtoken: "token",
+		Region:    "eu",
+		WebAddr:   "localhost:4041",
+		LogLevel:  "info",
+	}
+	definitions := []TunnelDefinition{
+		{Name: "ssh", Proto: tunnelProtoTCP, Addr: "22", RemoteAddr: "1.tcp.ngrok.io:12345", AllowCIDRs: []string{"203.0.113.0/24"}, DenyCIDRs: []string{"203.0.113.1/32"}},
+		{Name: "web", Proto: tunnelProtoHTTP, Addr: "8080", Hostname: "web.example.com", Auth: "user:password", BindTLS: bindTLSBoth},
+	}
+
+	tests := []struct {
+		name    string
+		version NgrokAgentVersion
+		want    string
+	}{
+		{
+			name:    "v2 agent",
+			version: "2.3.41",
+			want: `authtoken: token
+region: eu
+web_addr: localhost:4041
+log: stdout
+log_level: info
+tunnels:
+  ssh:
+    addr: "22"
+    proto: tcp
+    remote_addr: 1.tcp.ngrok.io:12345
+  web:
+    addr: "8080"
+    proto: http
+    hostname: web.example.com
+    auth: user:password
+    bind_tls: both
+`,
+		},
+		{
+			name:    "v3 agent, config version 2",
+			version: "3.5.0",
+			want: `version: "2"
+authtoken: token
+region: eu
+web_addr: localhost:4041
+log: stdout
+log_level: info
+tunnels:
+  ssh:
+    addr: "22"
+    proto: tcp
+    remote_addr: 1.tcp.ngrok.io:12345
+    ip_restriction:
+      allow_cidrs:
+      - 203.0.113.0/24
+      deny_cidrs:
+      - 203.0.113.1/32
+  web:
+    addr: "8080"
+    proto: http
+    domain: web.example.com
+    basic_auth:
+    - user:password
+    schemes:
+    - http
+    - https
+`,
+		},
+		{
+			name:    "v3 agent, config version 3",
+			version: "3.16.0",
+			want: `version: "3"
+agent:
+  authtoken: token
+  web_addr: localhost:4041
+  log: stdout
+  log_level: info
+tunnels:
+  ssh:
+    addr: "22"
+    proto: tcp
+    remote_addr: 1.tcp.ngrok.io:12345
+    ip_restriction:
+      allow_cidrs:
+      - 203.0.113.0/24
+      deny_cidrs:
+      - 203.0.113.1/32
+  web:
+    addr: "8080"
+    proto: http
+    domain: web.example.com
+    basic_auth:
+    - user:password
+    schemes:
+    - http
+    - https
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ngrokConfig interface{}
+			if configVersion := tt.version.configVersion(); configVersion == "" {
+				ngrokConfig = ngrokV2Config(options, definitions)
+			} else {
+				ngrokConfig = ngrokV3Config(configVersion, options, definitions)
+			}
+
+			got, err := yaml.Marshal(ngrokConfig)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("unexpected config:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/rand"
+	"math/big"
+
+	"github.com/bitrise-io/go-utils/log"
+	"github.com/pkg/errors"
+)
+
+const passwordAlphabet = "abcdefghijkmnopqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789-_.+=!@#%"
+
+// generatePassword returns a random password of the given length, using characters from the given alphabet.
+func generatePassword(length int, alphabet string) (string, error) {
+	password := make([]byte, length)
+	max := big.NewInt(int64(len(alphabet)))
+	for i := range password {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+		password[i] = alphabet[n.Int64()]
+	}
+	return string(password), nil
+}
+
+const (
+	// legacy VNC authentication (DES challenge) only uses the first 8 characters of the password
+	vncPasswordMaxLength = 8
+
+	vncPasswordOutputKey    = "REMOTE_ACCESS_SCREEN_SHARE_PASSWORD"
+	vncPasswordArtifactName = "remote-access-screen-share-password"
+)
+
+// generateVNCPassword generates a one-time Screen Share password, exports it as a sensitive step output,
+// and writes it into the deploy dir encrypted to the artifact recipient, if specified.
+// If enabled, the generated password is used as the user password too.
+func (configs *ConfigsModel) generateVNCPassword() error {
+	password, err := generatePassword(vncPasswordMaxLength, passwordAlphabet)
+	if err != nil {
+		return errors.Wrap(err, "Failed to generate Screen Share password")
+	}
+
+	if err := exportSensitiveOutput(vncPasswordOutputKey, password); err != nil {
+		return errors.Wrapf(err, "Failed to export %s", vncPasswordOutputKey)
+	}
+	log.Printf("The Screen Share password is exported as $%s", vncPasswordOutputKey)
+
+	if configs.ArtifactRecipient != "" {
+		pth, err := writeEncryptedArtifact(configs.ArtifactRecipient, vncPasswordArtifactName, []byte(password))
+		if err != nil {
+			return errors.Wrap(err, "Failed to write the encrypted Screen Share password")
+		}
+		log.Printf("The encrypted Screen Share password is written to: %s", pth)
+	}
+
+	configs.VNCPassword = password
+	configs.isVNCPasswordGenerated = true
+	if configs.ApplyGeneratedPasswordToUser && configs.UserPassword == "" {
+		configs.UserPassword = password
+	}
+	return nil
+}
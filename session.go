@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+	"github.com/bitrise-steplib/steps-remote-access-macos-ngrok/internal/ngrokapi"
+	"github.com/pkg/errors"
+)
+
+const sessionPollInterval = 10 * time.Second
+
+// signalContext returns a context which is cancelled on SIGINT or SIGTERM.
+func signalContext() (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		select {
+		case sig := <-signals:
+			fmt.Println()
+			log.Warnf("Received %s signal", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, func() {
+		signal.Stop(signals)
+		cancel()
+	}
+}
+
+// checkInterrupted returns an error if the context is cancelled, so the setup stops once the step is aborted.
+func checkInterrupted(ctx context.Context) error {
+	if ctx.Err() != nil {
+		return errors.New("Interrupted during setup")
+	}
+	return nil
+}
+
+// waitForSessionEnd blocks until the session lifetime or the idle timeout expires,
+// or the context is cancelled, and returns the reason why the session ended.
+// It returns an error if ngrok failed in the meantime.
+// A zero sessionTimeout or idleTimeout disables the given limit.
+func waitForSessionEnd(ctx context.Context, ngrokFailed <-chan error, sessionTimeout, idleTimeout time.Duration) (string, error) {
+	startTime := time.Now()
+	lastActiveTime := startTime
+
+	for {
+		fmt.Print(".")
+		select {
+		case <-ctx.Done():
+			return "interrupted", nil
+		case err := <-ngrokFailed:
+			return "", err
+		case <-time.After(sessionPollInterval):
+		}
+
+		now := time.Now()
+		if sessionTimeout > 0 && now.Sub(startTime) >= sessionTimeout {
+			return fmt.Sprintf("maximum session duration (%s) reached", sessionTimeout), nil
+		}
+
+		if idleTimeout <= 0 {
+			continue
+		}
+
+		tunnels, err := ngrokAPI.ListTunnels(ctx)
+		if err != nil {
+			if isDebugMode {
+				log.Warnf("Failed to fetch tunnel metrics: %s", err)
+			}
+		} else if hasActiveConnection(tunnels) {
+			lastActiveTime = now
+		}
+
+		if now.Sub(lastActiveTime) >= idleTimeout {
+			return fmt.Sprintf("no active connection for %s (idle timeout)", idleTimeout), nil
+		}
+	}
+}
+
+func hasActiveConnection(tunnels []ngrokapi.Tunnel) bool {
+	for _, tunnel := range tunnels {
+		if tunnel.Metrics.Conns.Gauge > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+
+	"github.com/bitrise-io/go-utils/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	sessionUserPasswordLength    = 20
+	sessionUserPasswordOutputKey = "REMOTE_ACCESS_USER_PASSWORD"
+	sessionUserPasswordArtifact  = "remote-access-user-password"
+	sshAccessGroup               = "com.apple.access_ssh"
+)
+
+var sessionUsernameRegexp = regexp.MustCompile(`^[a-z_][a-z0-9_-]{0,30}$`)
+
+// SessionUser is the macOS user the remote access is configured for.
+type SessionUser struct {
+	Username    string
+	HomeDir     string
+	IsTemporary bool
+
+	// authorizedKeysPth is where the SSH keys are collected for a temporary user,
+	// until those are installed into its home
+	authorizedKeysPth string
+}
+
+// AuthorizedKeysPath returns the authorized_keys file the SSH keys of the session have to be added to.
+func (sessionUser SessionUser) AuthorizedKeysPath() string {
+	if sessionUser.authorizedKeysPth != "" {
+		return sessionUser.authorizedKeysPth
+	}
+	return filepath.Join(sessionUser.HomeDir, ".ssh", "authorized_keys")
+}
+
+func currentSessionUser() (SessionUser, error) {
+	u, err := user.Current()
+	if err != nil {
+		return SessionUser{}, errors.WithStack(err)
+	}
+	return SessionUser{Username: u.Username, HomeDir: u.HomeDir}, nil
+}
+
+func validateSessionUsername(username string) error {
+	if !sessionUsernameRegexp.MatchString(username) {
+		return errors.Errorf("invalid username: %s", username)
+	}
+	return nil
+}
+
+// CreateTemporaryUser creates a local user for the session, which is deleted at the end of the session.
+// If isSudoer is set the user can run any command with sudo, without entering its password.
+func CreateTemporaryUser(username, password string, isAdmin, isSudoer bool) (SessionUser, error) {
+	if _, err := user.Lookup(username); err == nil {
+		return SessionUser{}, errors.Errorf("User %s already exists", username)
+	}
+
+	log.Printf(" (!) Creating temporary user: %s", username)
+
+	if err := stepJournal.Record(JournalEntry{Kind: journalEntryUser, Username: username}); err != nil {
+		return SessionUser{}, err
+	}
+
+	args := []string{"sysadminctl", "-addUser", username, "-fullName", "Remote Access", "-password", password}
+	if isAdmin {
+		args = append(args, "-admin")
+	}
+	if out, err := newSudoCommand(args...).RunAndReturnTrimmedCombinedOutput(); err != nil {
+		return SessionUser{}, errors.Wrapf(err, "Failed to create user: %s", out)
+	}
+
+	if out, err := newSudoCommand("createhomedir", "-c", "-u", username).RunAndReturnTrimmedCombinedOutput(); err != nil {
+		return SessionUser{}, errors.Wrapf(err, "Failed to create the home of the user: %s", out)
+	}
+
+	// if Remote Login is restricted to a group of users, the temporary user has to be a member of it
+	if err := newCommand("dscl", ".", "-read", "/Groups/"+sshAccessGroup).Run(); err == nil {
+		if out, err := newSudoCommand("dseditgroup", "-o", "edit", "-a", username, "-t", "user", sshAccessGroup).RunAndReturnTrimmedCombinedOutput(); err != nil {
+			return SessionUser{}, errors.Wrapf(err, "Failed to allow Remote Login for the user: %s", out)
+		}
+	}
+
+	if isSudoer {
+		sudoersPth := filepath.Join("/etc/sudoers.d", "remote-access-"+username)
+		if err := stepJournal.RecordRootFile(sudoersPth); err != nil {
+			return SessionUser{}, err
+		}
+		if err := writeRootFile(sudoersPth, []byte(fmt.Sprintf("%s ALL=(ALL) NOPASSWD: ALL\n", username)), 0440); err != nil {
+			return SessionUser{}, errors.Wrap(err, "Failed to grant sudo rights to the user")
+		}
+	}
+
+	u, err := user.Lookup(username)
+	if err != nil {
+		return SessionUser{}, errors.WithStack(err)
+	}
+
+	stagingDir, err := ioutil.TempDir("", "remote-access-ssh")
+	if err != nil {
+		return SessionUser{}, errors.WithStack(err)
+	}
+
+	return SessionUser{
+		Username:          username,
+		HomeDir:           u.HomeDir,
+		IsTemporary:       true,
+		authorizedKeysPth: filepath.Join(stagingDir, "authorized_keys"),
+	}, nil
+}
+
+// InstallAuthorizedKeys moves the SSH keys collected for a temporary user into its home.
+func (sessionUser SessionUser) InstallAuthorizedKeys() error {
+	if sessionUser.authorizedKeysPth == "" {
+		return nil
+	}
+
+	if _, err := os.Stat(sessionUser.authorizedKeysPth); os.IsNotExist(err) {
+		return nil
+	}
+
+	sshDir := filepath.Join(sessionUser.HomeDir, ".ssh")
+	if err := newSudoCommand("install", "-d", "-m", "700", "-o", sessionUser.Username, sshDir).Run(); err != nil {
+		return errors.Wrapf(err, "Failed to create %s", sshDir)
+	}
+	if err := newSudoCommand("install", "-m", "600", "-o", sessionUser.Username, sessionUser.authorizedKeysPth, filepath.Join(sshDir, "authorized_keys")).Run(); err != nil {
+		return errors.Wrap(err, "Failed to install authorized_keys")
+	}
+	return errors.WithStack(os.RemoveAll(filepath.Dir(sessionUser.authorizedKeysPth)))
+}
+
+func deleteTemporaryUser(username string) error {
+	if _, err := user.Lookup(username); err != nil {
+		// already deleted
+		return nil
+	}
+	if out, err := newSudoCommand("sysadminctl", "-deleteUser", username).RunAndReturnTrimmedCombinedOutput(); err != nil {
+		return errors.Wrapf(err, "Failed to delete user: %s", out)
+	}
+	return nil
+}
+
+// exportSessionUserPassword exports the password of a temporary user as a sensitive step output,
+// and writes it into the deploy dir encrypted to the recipient, if specified.
+func exportSessionUserPassword(password, recipient string) error {
+	if err := exportSensitiveOutput(sessionUserPasswordOutputKey, password); err != nil {
+		return errors.Wrapf(err, "Failed to export %s", sessionUserPasswordOutputKey)
+	}
+	log.Printf("The password of the user is exported as $%s", sessionUserPasswordOutputKey)
+
+	if recipient != "" {
+		pth, err := writeEncryptedArtifact(recipient, sessionUserPasswordArtifact, []byte(password))
+		if err != nil {
+			return errors.Wrap(err, "Failed to write the encrypted password")
+		}
+		log.Printf("The encrypted password is written to: %s", pth)
+	}
+	return nil
+}
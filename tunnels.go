@@ -0,0 +1,474 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/sliceutil"
+	"github.com/bitrise-steplib/steps-remote-access-macos-ngrok/internal/ngrokapi"
+	"github.com/pkg/errors"
+)
+
+// tunnel protocols
+const (
+	tunnelProtoTCP  = "tcp"
+	tunnelProtoHTTP = "http"
+	tunnelProtoTLS  = "tls"
+)
+
+// names of the tunnels managed by the step
+const (
+	sshTunnelName = "ssh"
+	vncTunnelName = "vnc"
+)
+
+// bind_tls values of http tunnels
+const (
+	bindTLSTrue  = "true"
+	bindTLSFalse = "false"
+	bindTLSBoth  = "both"
+)
+
+// ngrokMinBasicAuthPasswordLength is the minimum password length ngrok accepts for basic auth.
+const ngrokMinBasicAuthPasswordLength = 8
+
+var tunnelNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// TunnelDefinition is a tunnel to open with ngrok.
+type TunnelDefinition struct {
+	Name      string
+	Proto     string
+	Addr      string
+	Subdomain string
+	Hostname  string
+	// RemoteAddr is the reserved address of a tcp tunnel
+	RemoteAddr string
+
+	// http tunnel options
+	Auth       string
+	HostHeader string
+	BindTLS    string
+	Inspect    *bool
+
+	// IP restriction, only supported by the v3 agent
+	AllowCIDRs []string
+	DenyCIDRs  []string
+}
+
+func (definition TunnelDefinition) String() string {
+	s := fmt.Sprintf("%s (%s, %s", definition.Name, definition.Proto, definition.Addr)
+	if definition.Subdomain != "" {
+		s += ", subdomain: " + definition.Subdomain
+	}
+	if definition.Hostname != "" {
+		s += ", hostname: " + definition.Hostname
+	}
+	if definition.RemoteAddr != "" {
+		s += ", remote_addr: " + definition.RemoteAddr
+	}
+	if definition.Auth != "" {
+		s += ", auth: ***"
+	}
+	if definition.HostHeader != "" {
+		s += ", host_header: " + definition.HostHeader
+	}
+	if definition.BindTLS != "" {
+		s += ", bind_tls: " + definition.BindTLS
+	}
+	if definition.Inspect != nil {
+		s += fmt.Sprintf(", inspect: %t", *definition.Inspect)
+	}
+	if len(definition.AllowCIDRs) > 0 {
+		s += ", allow: " + strings.Join(definition.AllowCIDRs, " ")
+	}
+	if len(definition.DenyCIDRs) > 0 {
+		s += ", deny: " + strings.Join(definition.DenyCIDRs, " ")
+	}
+	return s + ")"
+}
+
+func (definition TunnelDefinition) hasIPRestriction() bool {
+	return len(definition.AllowCIDRs) > 0 || len(definition.DenyCIDRs) > 0
+}
+
+// ngrokConfig returns the config of the tunnel for the v2 agent.
+func (definition TunnelDefinition) ngrokConfig() NgrokTunnelConfig {
+	config := NgrokTunnelConfig{
+		Addr:       definition.Addr,
+		Proto:      definition.Proto,
+		Subdomain:  definition.Subdomain,
+		Hostname:   definition.Hostname,
+		RemoteAddr: definition.RemoteAddr,
+		Auth:       definition.Auth,
+		HostHeader: definition.HostHeader,
+		Inspect:    definition.Inspect,
+	}
+	// ngrok expects a boolean, or the both string
+	switch definition.BindTLS {
+	case bindTLSTrue:
+		config.BindTLS = true
+	case bindTLSFalse:
+		config.BindTLS = false
+	case bindTLSBoth:
+		config.BindTLS = bindTLSBoth
+	}
+	return config
+}
+
+// ngrokV3Config returns the config of the tunnel for the v3 agent.
+func (definition TunnelDefinition) ngrokV3Config() NgrokV3TunnelConfig {
+	config := NgrokV3TunnelConfig{
+		Addr:       definition.Addr,
+		Proto:      definition.Proto,
+		Subdomain:  definition.Subdomain,
+		Domain:     definition.Hostname,
+		RemoteAddr: definition.RemoteAddr,
+		HostHeader: definition.HostHeader,
+		Inspect:    definition.Inspect,
+	}
+	if definition.Auth != "" {
+		config.BasicAuth = []string{definition.Auth}
+	}
+	if definition.hasIPRestriction() {
+		config.IPRestriction = &NgrokIPRestriction{AllowCIDRs: definition.AllowCIDRs, DenyCIDRs: definition.DenyCIDRs}
+	}
+	// bind_tls is replaced by the schemes to serve
+	switch definition.BindTLS {
+	case bindTLSTrue:
+		config.Schemes = []string{"https"}
+	case bindTLSFalse:
+		config.Schemes = []string{"http"}
+	case bindTLSBoth:
+		config.Schemes = []string{"http", "https"}
+	}
+	return config
+}
+
+// startTunnelRequest returns the agent API request starting the tunnel, in the format of the given agent version.
+func (definition TunnelDefinition) startTunnelRequest(version NgrokAgentVersion) ngrokapi.StartTunnelRequest {
+	request := ngrokapi.StartTunnelRequest{
+		Name:       definition.Name,
+		Proto:      definition.Proto,
+		Addr:       definition.Addr,
+		Subdomain:  definition.Subdomain,
+		RemoteAddr: definition.RemoteAddr,
+		HostHeader: definition.HostHeader,
+		Inspect:    definition.Inspect,
+	}
+
+	if version.Major() == "2" {
+		config := definition.ngrokConfig()
+		request.Hostname = config.Hostname
+		request.Auth = config.Auth
+		request.BindTLS = config.BindTLS
+		return request
+	}
+
+	config := definition.ngrokV3Config()
+	request.Domain = config.Domain
+	request.BasicAuth = config.BasicAuth
+	request.Schemes = config.Schemes
+	return request
+}
+
+func (definition TunnelDefinition) validate() error {
+	if !tunnelNameRegexp.MatchString(definition.Name) {
+		return errors.Errorf("invalid name (%s), only letters, digits, - and _ are allowed", definition.Name)
+	}
+
+	switch definition.Proto {
+	case tunnelProtoTCP:
+		if definition.Subdomain != "" || definition.Hostname != "" {
+			return errors.Errorf("tunnel %s: subdomain and hostname are only supported by %s and %s tunnels", definition.Name, tunnelProtoHTTP, tunnelProtoTLS)
+		}
+		if definition.RemoteAddr != "" {
+			if _, port, err := net.SplitHostPort(definition.RemoteAddr); err != nil || validatePort(port) != nil {
+				return errors.Errorf("tunnel %s: invalid remote_addr (%s), should be a reserved host:port, e.g. 1.tcp.ngrok.io:12345", definition.Name, definition.RemoteAddr)
+			}
+		}
+	case tunnelProtoHTTP, tunnelProtoTLS:
+		if definition.Subdomain != "" && definition.Hostname != "" {
+			return errors.Errorf("tunnel %s: either subdomain or hostname can be specified, not both", definition.Name)
+		}
+		if definition.RemoteAddr != "" {
+			return errors.Errorf("tunnel %s: remote_addr is only supported by %s tunnels", definition.Name, tunnelProtoTCP)
+		}
+	default:
+		return errors.Errorf("tunnel %s: invalid proto (%s), should be one of: %s, %s, %s", definition.Name, definition.Proto, tunnelProtoTCP, tunnelProtoHTTP, tunnelProtoTLS)
+	}
+
+	if err := validateTunnelAddr(definition.Addr); err != nil {
+		return errors.Wrapf(err, "tunnel %s", definition.Name)
+	}
+	for _, cidr := range append(append([]string{}, definition.AllowCIDRs...), definition.DenyCIDRs...) {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return errors.Errorf("tunnel %s: invalid CIDR: %s", definition.Name, cidr)
+		}
+	}
+	if err := definition.validateHTTPOptions(); err != nil {
+		return errors.Wrapf(err, "tunnel %s", definition.Name)
+	}
+	return nil
+}
+
+func (definition TunnelDefinition) validateHTTPOptions() error {
+	if definition.Proto != tunnelProtoHTTP {
+		if definition.Auth != "" || definition.HostHeader != "" || definition.BindTLS != "" || definition.Inspect != nil {
+			return errors.Errorf("auth, host_header, bind_tls and inspect are only supported by %s tunnels", tunnelProtoHTTP)
+		}
+		return nil
+	}
+
+	if definition.Auth != "" {
+		credentials := strings.SplitN(definition.Auth, ":", 2)
+		if len(credentials) != 2 || credentials[0] == "" {
+			return errors.New("invalid auth, should be username:password")
+		}
+		if len(credentials[1]) < ngrokMinBasicAuthPasswordLength {
+			return errors.Errorf("invalid auth, the password should be at least %d characters long", ngrokMinBasicAuthPasswordLength)
+		}
+	}
+	if strings.ContainsAny(definition.HostHeader, " \t") {
+		return errors.Errorf("invalid host_header (%s), should be rewrite, preserve or a hostname", definition.HostHeader)
+	}
+	switch definition.BindTLS {
+	case "", bindTLSTrue, bindTLSFalse, bindTLSBoth:
+	default:
+		return errors.Errorf("invalid bind_tls (%s), should be one of: %s, %s, %s", definition.BindTLS, bindTLSTrue, bindTLSFalse, bindTLSBoth)
+	}
+	return nil
+}
+
+// parseIPRestriction parses the IP addresses and CIDRs to allow, the ones prefixed with ! to deny.
+// IP addresses are returned as single address CIDRs.
+func parseIPRestriction(items []string) (allow, deny []string, err error) {
+	for _, item := range items {
+		pattern := strings.TrimPrefix(item, "!")
+		cidr := pattern
+		if _, _, err := net.ParseCIDR(pattern); err != nil {
+			ip := net.ParseIP(pattern)
+			if ip == nil {
+				return nil, nil, errors.Errorf("invalid source address, should be an IP address or CIDR: %s", item)
+			}
+			if ip.To4() != nil {
+				cidr = pattern + "/32"
+			} else {
+				cidr = pattern + "/128"
+			}
+		}
+
+		if strings.HasPrefix(item, "!") {
+			deny = append(deny, cidr)
+		} else {
+			allow = append(allow, cidr)
+		}
+	}
+	return allow, deny, nil
+}
+
+// validateTunnelAddr checks if the local address is a port or a host:port pair.
+func validateTunnelAddr(addr string) error {
+	if addr == "" {
+		return errors.New("no addr specified")
+	}
+
+	port := addr
+	if strings.Contains(addr, ":") {
+		var err error
+		if _, port, err = net.SplitHostPort(addr); err != nil {
+			return errors.Errorf("invalid addr (%s), should be a port or host:port", addr)
+		}
+	}
+	if err := validatePort(port); err != nil {
+		return errors.Errorf("invalid addr (%s), should be a port or host:port", addr)
+	}
+	return nil
+}
+
+func validatePort(port string) error {
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 1 || p > 65535 {
+		return errors.Errorf("invalid port: %s", port)
+	}
+	return nil
+}
+
+// parseTunnelDefinitions parses the newline separated tunnel definitions,
+// a definition is a comma separated list of key=value pairs, e.g.:
+//
+//	name=appium, proto=tcp, addr=4723
+//
+// Empty lines and comments are skipped, proto defaults to tcp.
+func parseTunnelDefinitions(value string) ([]TunnelDefinition, error) {
+	var definitions []TunnelDefinition
+	for i, line := range strings.Split(value, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		definition, err := parseTunnelDefinition(line)
+		if err != nil {
+			return nil, errors.Wrapf(err, "line %d", i+1)
+		}
+		definitions = append(definitions, definition)
+	}
+	return definitions, nil
+}
+
+// tunnelDefinitionKeys are the keys of a tunnel definition.
+var tunnelDefinitionKeys = []string{"name", "proto", "addr", "subdomain", "hostname", "remote_addr", "auth", "host_header", "bind_tls", "inspect"}
+
+// splitTunnelDefinition splits the definition into key=value fields.
+// The basic auth password may contain commas: the fields following auth are part of the credentials,
+// until a field starting with a known key and =.
+func splitTunnelDefinition(line string) []string {
+	var fields []string
+	for _, field := range strings.Split(line, ",") {
+		key := tunnelDefinitionFieldKey(field)
+		if key == "" && len(fields) > 0 && tunnelDefinitionFieldKey(fields[len(fields)-1]) == "auth" {
+			fields[len(fields)-1] += "," + field
+			continue
+		}
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+// tunnelDefinitionFieldKey returns the key of the key=value field, or an empty string if the key is unknown.
+func tunnelDefinitionFieldKey(field string) string {
+	kv := strings.SplitN(field, "=", 2)
+	if len(kv) != 2 {
+		return ""
+	}
+	if key := strings.TrimSpace(kv[0]); sliceutil.IsStringInSlice(key, tunnelDefinitionKeys) {
+		return key
+	}
+	return ""
+}
+
+func parseTunnelDefinition(line string) (TunnelDefinition, error) {
+	definition := TunnelDefinition{Proto: tunnelProtoTCP}
+	for _, field := range splitTunnelDefinition(line) {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return TunnelDefinition{}, errors.Errorf("invalid field (%s), should be key=value", field)
+		}
+		key, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+
+		switch key {
+		case "name":
+			definition.Name = value
+		case "proto":
+			definition.Proto = value
+		case "addr":
+			definition.Addr = value
+		case "subdomain":
+			definition.Subdomain = value
+		case "hostname":
+			definition.Hostname = value
+		case "remote_addr":
+			definition.RemoteAddr = value
+		case "auth":
+			definition.Auth = value
+		case "host_header":
+			definition.HostHeader = value
+		case "bind_tls":
+			definition.BindTLS = value
+		case "inspect":
+			inspect, err := strconv.ParseBool(value)
+			if err != nil {
+				return TunnelDefinition{}, errors.Errorf("invalid inspect (%s), should be true or false", value)
+			}
+			definition.Inspect = &inspect
+		default:
+			return TunnelDefinition{}, errors.Errorf("unknown key: %s", key)
+		}
+	}
+	return definition, nil
+}
+
+// validateTunnelDefinitions validates every definition and checks that the names are unique.
+func validateTunnelDefinitions(definitions []TunnelDefinition) error {
+	names := map[string]bool{}
+	for _, definition := range definitions {
+		if err := definition.validate(); err != nil {
+			return err
+		}
+		if names[definition.Name] {
+			return errors.Errorf("duplicated tunnel name: %s", definition.Name)
+		}
+		names[definition.Name] = true
+	}
+	return nil
+}
+
+// tunnelDefinitionName returns the name of the definition the agent tunnel belongs to:
+// the agent opens an additional "<name> (http)" tunnel for the http tunnels bound to both http and https.
+func tunnelDefinitionName(tunnelName string) string {
+	return strings.TrimSuffix(tunnelName, " (http)")
+}
+
+// missingTunnels returns the names of the defined tunnels, which are not running yet with a public URL.
+func missingTunnels(definitions []TunnelDefinition, tunnels []ngrokapi.Tunnel) []string {
+	up := map[string]bool{}
+	for _, tunnel := range tunnels {
+		if tunnel.PublicURL != "" {
+			up[tunnelDefinitionName(tunnel.Name)] = true
+		}
+	}
+
+	var missing []string
+	for _, definition := range definitions {
+		if !up[definition.Name] {
+			missing = append(missing, definition.Name)
+		}
+	}
+	return missing
+}
+
+// verifyTunnelReservations checks if the public address of every tunnel matches
+// the reserved address or hostname requested for it.
+func verifyTunnelReservations(definitions []TunnelDefinition, tunnels []ngrokapi.Tunnel) error {
+	definitionByName := map[string]TunnelDefinition{}
+	for _, definition := range definitions {
+		definitionByName[definition.Name] = definition
+	}
+
+	for _, tunnel := range tunnels {
+		definition, ok := definitionByName[tunnelDefinitionName(tunnel.Name)]
+		if !ok {
+			continue
+		}
+
+		publicURL, err := url.Parse(tunnel.PublicURL)
+		if err != nil {
+			return errors.Wrapf(err, "tunnel %s: invalid public URL (%s)", tunnel.Name, tunnel.PublicURL)
+		}
+
+		switch {
+		case definition.RemoteAddr != "":
+			if !strings.EqualFold(publicURL.Host, definition.RemoteAddr) {
+				return errors.Errorf("tunnel %s: the reserved address (%s) was not honored, the tunnel is available at: %s", tunnel.Name, definition.RemoteAddr, tunnel.PublicURL)
+			}
+		case definition.Hostname != "":
+			if !strings.EqualFold(publicURL.Hostname(), definition.Hostname) {
+				return errors.Errorf("tunnel %s: the reserved hostname (%s) was not honored, the tunnel is available at: %s", tunnel.Name, definition.Hostname, tunnel.PublicURL)
+			}
+		case definition.Subdomain != "":
+			if !strings.HasPrefix(strings.ToLower(publicURL.Hostname()), strings.ToLower(definition.Subdomain)+".") {
+				return errors.Errorf("tunnel %s: the reserved subdomain (%s) was not honored, the tunnel is available at: %s", tunnel.Name, definition.Subdomain, tunnel.PublicURL)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/bitrise-steplib/steps-remote-access-macos-ngrok/internal/ngrokapi"
+)
+
+func TestParseTunnelDefinitions(t *testing.T) {
+	inspect := false
+
+	tests := []struct {
+		name    string
+		value   string
+		want    []TunnelDefinition
+		wantErr bool
+	}{
+		{
+			name:  "empty",
+			value: "",
+			want:  nil,
+		},
+		{
+			name:  "default proto",
+			value: "name=inspector, addr=9222",
+			want:  []TunnelDefinition{{Name: "inspector", Proto: tunnelProtoTCP, Addr: "9222"}},
+		},
+		{
+			name: "multiple tunnels, blank lines and comments",
+			value: `
+# Chrome DevTools
+name=inspector,addr=9222
+
+name=web, proto=http, addr=localhost:8080, subdomain=my-web, auth=user:password, host_header=rewrite, bind_tls=true, inspect=false
+name=db, remote_addr=1.tcp.ngrok.io:12345, addr=5432,
+`,
+			want: []TunnelDefinition{
+				{Name: "inspector", Proto: tunnelProtoTCP, Addr: "9222"},
+				{Name: "web", Proto: tunnelProtoHTTP, Addr: "localhost:8080", Subdomain: "my-web", Auth: "user:password", HostHeader: "rewrite", BindTLS: bindTLSTrue, Inspect: &inspect},
+				{Name: "db", Proto: tunnelProtoTCP, Addr: "5432", RemoteAddr: "1.tcp.ngrok.io:12345"},
+			},
+		},
+		{
+			name:  "auth password with commas",
+			value: "name=web, proto=http, auth=user:pass,word, 1, addr=80",
+			want:  []TunnelDefinition{{Name: "web", Proto: tunnelProtoHTTP, Addr: "80", Auth: "user:pass,word, 1"}},
+		},
+		{
+			name:    "missing value",
+			value:   "name=web, addr",
+			wantErr: true,
+		},
+		{
+			name:    "unknown key",
+			value:   "name=web, addr=80, port=80",
+			wantErr: true,
+		},
+		{
+			name:    "invalid inspect",
+			value:   "name=web, proto=http, addr=80, inspect=maybe",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTunnelDefinitions(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error: %v, wantErr: %t", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("unexpected definitions:\n got: %v\nwant: %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyTunnelReservations(t *testing.T) {
+	definitions := []TunnelDefinition{
+		{Name: "ssh", Proto: tunnelProtoTCP, Addr: "22", RemoteAddr: "1.tcp.ngrok.io:12345"},
+		{Name: "web", Proto: tunnelProtoHTTP, Addr: "8080", Hostname: "web.example.com"},
+		{Name: "api", Proto: tunnelProtoHTTP, Addr: "3000", Subdomain: "my-api"},
+		{Name: "inspector", Proto: tunnelProtoTCP, Addr: "9222"},
+	}
+
+	tests := []struct {
+		name    string
+		tunnels []ngrokapi.Tunnel
+		wantErr bool
+	}{
+		{
+			name: "reservations honored",
+			tunnels: []ngrokapi.Tunnel{
+				{Name: "ssh", PublicURL: "tcp://1.tcp.ngrok.io:12345"},
+				{Name: "web", PublicURL: "https://WEB.example.com"},
+				{Name: "web (http)", PublicURL: "http://web.example.com"},
+				{Name: "api", PublicURL: "https://my-api.ngrok.io"},
+				{Name: "inspector", PublicURL: "tcp://0.tcp.ngrok.io:23456"},
+				{Name: "opened-later", PublicURL: "tcp://0.tcp.ngrok.io:34567"},
+			},
+		},
+		{
+			name:    "reserved address not honored",
+			tunnels: []ngrokapi.Tunnel{{Name: "ssh", PublicURL: "tcp://0.tcp.ngrok.io:12345"}},
+			wantErr: true,
+		},
+		{
+			name:    "reserved hostname not honored",
+			tunnels: []ngrokapi.Tunnel{{Name: "web (http)", PublicURL: "http://abcd.ngrok.io"}},
+			wantErr: true,
+		},
+		{
+			name:    "reserved subdomain not honored",
+			tunnels: []ngrokapi.Tunnel{{Name: "api", PublicURL: "https://my-api-2.ngrok.io"}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := verifyTunnelReservations(definitions, tt.tunnels); (err != nil) != tt.wantErr {
+				t.Errorf("error: %v, wantErr: %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMissingTunnels(t *testing.T) {
+	definitions := []TunnelDefinition{{Name: "ssh"}, {Name: "vnc"}, {Name: "web"}}
+
+	tests := []struct {
+		name    string
+		tunnels []ngrokapi.Tunnel
+		want    []string
+	}{
+		{
+			name:    "no tunnel up",
+			tunnels: nil,
+			want:    []string{"ssh", "vnc", "web"},
+		},
+		{
+			name: "tunnel without public URL",
+			tunnels: []ngrokapi.Tunnel{
+				{Name: "ssh", PublicURL: "tcp://0.tcp.ngrok.io:12345"},
+				{Name: "vnc"},
+			},
+			want: []string{"vnc", "web"},
+		},
+		{
+			name: "every tunnel up, the http tunnel of the v2 agent counts",
+			tunnels: []ngrokapi.Tunnel{
+				{Name: "ssh", PublicURL: "tcp://0.tcp.ngrok.io:12345"},
+				{Name: "vnc", PublicURL: "tcp://0.tcp.ngrok.io:23456"},
+				{Name: "web (http)", PublicURL: "http://abcd.ngrok.io"},
+				{Name: "opened-later", PublicURL: "tcp://0.tcp.ngrok.io:34567"},
+			},
+			want: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := missingTunnels(definitions, tt.tunnels); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("unexpected missing tunnels: %v, want: %v", got, tt.want)
+			}
+		})
+	}
+}